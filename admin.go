@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// AdminToken guards the /admin endpoints, given as "Authorization: Bearer <token>". Empty turns them off.
+var AdminToken string
+
+// isAdmin reports if the request has the admin token, writing the error response if not
+func isAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if AdminToken == "" {
+		errorHandler(w, r, http.StatusNotFound, "admin endpoints are turned off; set -admin-token", nil)
+		return false
+	}
+	// only the header is accepted; a token in the url ends up in access logs and browser history
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) != 1 {
+		logEvent(r, "security", "rejected admin request from "+r.RemoteAddr)
+		errorHandler(w, r, http.StatusUnauthorized, "missing or wrong admin token", nil)
+		return false
+	}
+	return true
+}
+
+// OutboxHandler lists the emails that are dead or have failed at least once, as JSON
+func (s *Server) OutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(w, r) {
+		return
+	}
+	emails, err := s.Store.GetStuckOutboxEmails()
+	if err != nil {
+		errorHandler(w, r, http.StatusInternalServerError, "unable to get outbox", err)
+		return
+	}
+	if emails == nil {
+		emails = []OutboxEmail{}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	err = json.NewEncoder(w).Encode(emails)
+	if err != nil {
+		errorHandler(w, r, http.StatusInternalServerError, "unable to encode json", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BackdateDays is how many days back a subject like "yesterday: 5, 10, 15, 20" can credit reps
+var BackdateDays = 7
+
+// splitDatePrefix separates a leading day from the rep counts, ie, "2016-11-04: 5, 10" gives "2016-11-04" and "5, 10".
+// ok is false when the subject is not rep counts with a day in front, so other "Something: value" subjects are left alone.
+func splitDatePrefix(subject string) (day string, counts string, ok bool) {
+	parts := strings.SplitN(subject, ":", 2)
+	if len(parts) != 2 || !(isRepSubject(parts[1]) || isNamedRepSubject(parts[1])) {
+		return "", subject, false
+	}
+	day = strings.ToLower(strings.TrimSpace(parts[0]))
+	// anything that looks like an attempt at a date is kept, so a typo gets a helpful error
+	if day == "today" || day == "yesterday" || (day != "" && strings.Trim(day, "0123456789-/") == "") {
+		return day, parts[1], true
+	}
+	return "", subject, false
+}
+
+// creditDay resolves the day from splitDatePrefix to midnight in loc, and checks it is within BackdateDays of now and not in the future
+func creditDay(day string, now time.Time, loc *time.Location) (time.Time, error) {
+	today := startOfDay(now, loc)
+	var credited time.Time
+	switch day {
+	case "today":
+		credited = today
+	case "yesterday":
+		credited = today.AddDate(0, 0, -1)
+	default:
+		t, err := time.ParseInLocation("2006-01-02", day, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf(ErrBackdateDateFmt, day)
+		}
+		credited = t
+	}
+	if credited.After(today) || credited.Before(today.AddDate(0, 0, -BackdateDays)) {
+		return time.Time{}, fmt.Errorf(ErrBackdateRangeFmt, BackdateDays, credited.Format("Monday, Jan 2 2006"))
+	}
+	return credited, nil
+}
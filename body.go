@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// replyHeader matches the line mail clients put above a quoted reply, ie, "On Tue, Nov 1, 2016 at 9:00 AM, Someone <a@b.com> wrote:"
+var replyHeader = regexp.MustCompile(`^On .+ wrote:$`)
+
+// bodyLines are the trimmed, non empty lines of the plain text body, up to any signature or quoted reply
+func bodyLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		line = strings.TrimSpace(line)
+		if isBodyEnd(line) {
+			break
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// isBodyEnd reports if the line starts a signature or a quoted reply
+func isBodyEnd(line string) bool {
+	lower := strings.ToLower(line)
+	switch {
+	case line == "--", line == "__":
+		return true
+	case strings.HasPrefix(line, ">"):
+		return true
+	case replyHeader.MatchString(line):
+		return true
+	case strings.Contains(lower, "original message"), strings.HasPrefix(lower, "sent from my "):
+		return true
+	case strings.HasPrefix(line, "____"):
+		// outlook puts a line of underscores above the quoted message
+		return true
+	}
+	return false
+}
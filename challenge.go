@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+)
+
+// Challenge is a single season (ie, Movember 2016) and scopes which reps, exercises, and teams are counted
+type Challenge struct {
+	ID        int
+	Name      string
+	StartDate time.Time
+	EndDate   time.Time
+	// Exercises are the exercise names counted for the challenge. Empty means every active exercise.
+	Exercises []string
+	// Teams are the participating team names. Empty means every team.
+	Teams []string
+}
+
+// ExerciseNames lists the exercises for the challenge in display order
+func (c Challenge) ExerciseNames() []string {
+	if len(c.Exercises) == 0 {
+		return exerciseNames()
+	}
+	return c.Exercises
+}
+
+// HasExercise reports if the exercise counts for the challenge
+func (c Challenge) HasExercise(exercise string) bool {
+	for _, name := range c.ExerciseNames() {
+		if name == exercise {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTeam reports if the team participates in the challenge
+func (c Challenge) HasTeam(team string) bool {
+	if len(c.Teams) == 0 {
+		return true
+	}
+	for _, name := range c.Teams {
+		if name == team {
+			return true
+		}
+	}
+	return false
+}
+
+// IsActive reports if t falls within the challenge; the end date is inclusive
+func (c Challenge) IsActive(t time.Time) bool {
+	day := t.Format("2006-01-02")
+	return day >= c.StartDate.Format("2006-01-02") && day <= c.EndDate.Format("2006-01-02")
+}
+
+// daysElapsed is the number of days into the challenge as of now, counting the first day, in the given timezone
+func (c Challenge) daysElapsed(now time.Time, loc *time.Location) int {
+	start := time.Date(c.StartDate.Year(), c.StartDate.Month(), c.StartDate.Day(), 0, 0, 0, 0, loc)
+	today := startOfDay(now, loc)
+	if today.Before(start) {
+		return 0
+	}
+	end := time.Date(c.EndDate.Year(), c.EndDate.Month(), c.EndDate.Day(), 0, 0, 0, 0, loc)
+	if today.After(end) {
+		today = end
+	}
+	// round rather than truncate; a day with a DST change is 23 or 25 hours long
+	return int((today.Sub(start).Hours()+12)/24) + 1
+}
+
+// daysRemaining is the number of days left in the challenge as of now, counting today, in the given timezone
+func (c Challenge) daysRemaining(now time.Time, loc *time.Location) int {
+	start := time.Date(c.StartDate.Year(), c.StartDate.Month(), c.StartDate.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(c.EndDate.Year(), c.EndDate.Month(), c.EndDate.Day(), 0, 0, 0, 0, loc)
+	today := startOfDay(now, loc)
+	if today.Before(start) {
+		today = start
+	}
+	if today.After(end) {
+		return 0
+	}
+	// round rather than truncate, same as daysElapsed
+	return int((end.Sub(today).Hours()+12)/24) + 1
+}
+
+// totalDays is the length of the challenge, used for per day stats
+func (c Challenge) totalDays() int {
+	totalDays := int(c.EndDate.Sub(c.StartDate).Hours() / float64(24))
+	if totalDays <= 0 {
+		totalDays = 1 // avoid divide by zero
+	}
+	return totalDays
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// inboundMessage is what an InboundAdapter reads from an email. UserID and Exercises are filled in before the commands run.
+type inboundMessage struct {
+	To      string
+	From    string
+	Subject string
+	// Text is the plain text body
+	Text       string
+	MessageID  string
+	ReceivedAt time.Time
+	// Source is the provider it came from, ie, SourceSendGrid
+	Source string
+	// SPF and DKIM are the provider's checks, in the form of SendGrid's SPF and dkim fields, ie, "pass" and "{@sendgrid.com : pass}"
+	SPF    string
+	DKIM   string
+	UserID int
+	// Exercises come from the recipient address, ie, situps-pullups@countmyreps.com
+	Exercises []string
+}
+
+// commandResult is the outcome of one command, from the subject or a line of the body
+type commandResult struct {
+	Line string
+	// Notice says what the command did, for the success email
+	Notice string
+	// ErrMsg says why it failed, for the error email
+	ErrMsg string
+	// Report names the report to send in reply, ie, ReportStats, instead of a notice
+	Report string
+	// Unexpected is set when ErrMsg is for a database error, rather than something wrong with the line
+	Unexpected bool
+}
+
+// unexpectedResult is the failure for a database error while running the line
+func unexpectedResult(line string, what string) commandResult {
+	return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrUnexpectedFmt, what), Unexpected: true}
+}
+
+// Reports are replies that only read data
+const (
+	ReportStats = "stats"
+	ReportHelp  = "help"
+)
+
+// isReportCommand reports if the line asks for a report, ie, "stats" or "help"
+func isReportCommand(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.EqualFold(line, ReportStats) || strings.EqualFold(line, ReportHelp)
+}
+
+// isCommand reports if the line is something runCommand understands, as opposed to the rest of an email body
+func isCommand(line string) bool {
+	_, repLine, _ := splitDatePrefix(line)
+	lower := strings.ToLower(strings.TrimSpace(line))
+	return isReportCommand(line) ||
+		isRepSubject(repLine) ||
+		isNamedRepSubject(repLine) ||
+		isUndoSubject(line) ||
+		inListCaseInsenitive(line, Offices) ||
+		strings.Contains(lower, "team add:") ||
+		strings.Contains(lower, "team remove:") ||
+		strings.HasPrefix(lower, "timezone:") ||
+		strings.HasPrefix(lower, "digest:")
+}
+
+// isBodyCommand is isCommand for a line of the email body, where prose and signatures have numbers in them, ie,
+// "Did these at 6am with 3 friends" or "Engineer, Floor 4". Named reps there must name an exercise in the catalog.
+func isBodyCommand(line string) bool {
+	_, repLine, _ := splitDatePrefix(line)
+	if isNamedRepSubject(repLine) && !namesExercise(repLine) && !inListCaseInsenitive(line, Offices) {
+		return false
+	}
+	return isCommand(line)
+}
+
+// runCommand runs a single command, ie, "5, 10, 15, 20" or "Team Add: crossfit", for the sender of msg
+func (s *Server) runCommand(r *http.Request, msg inboundMessage, line string) commandResult {
+	var err error
+	exercises := msg.Exercises
+
+	// the subject (or line) is one of: a report, rep counts, an undo, an office name, a team change, a timezone, or a digest
+	if isReportCommand(line) {
+		report := strings.ToLower(strings.TrimSpace(line))
+		logEvent(r, "report", fmt.Sprintf("%s for %s", report, msg.From))
+		return commandResult{Line: line, Report: report}
+	}
+
+	day, repLine, isBackdated := splitDatePrefix(line)
+	if isRepSubject(repLine) || (isNamedRepSubject(repLine) && !inListCaseInsenitive(line, Offices)) {
+		var counts map[string]int
+		if isRepSubject(repLine) {
+			counts, err = parseRepCounts(repLine, exercises)
+			if err != nil {
+				logEvent(r, "bad_parse", fmt.Sprintf("reps do not match recipient %s: %s - %v", msg.To, line, err))
+				return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrExerciseCountFmt, len(exercises), extractEmailAddr(msg.To), strings.Join(exercises, ", "), len(strings.Split(repLine, ",")), line)}
+			}
+		} else {
+			// named exercises take the place of the ones in the address
+			exercises, counts, err = parseNamedRepCounts(repLine)
+			if err != nil {
+				logEvent(r, "bad_parse", fmt.Sprintf("bad named reps: %s - %v", line, err))
+				return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrNamedRepFmt, err, line, strings.Join(exerciseWords(), ", "))}
+			}
+		}
+
+		// reps are credited to when they arrive, or to noon of the day they name, where the sender is
+		loc := s.Store.GetUserLocation(msg.From)
+		creditedAt := msg.ReceivedAt
+		if isBackdated {
+			creditedDay, err := creditDay(day, msg.ReceivedAt, loc)
+			if err != nil {
+				logEvent(r, "bad_parse", fmt.Sprintf("bad backdate from %s: %s - %v", msg.From, line, err))
+				return commandResult{Line: line, ErrMsg: err.Error()}
+			}
+			creditedAt = creditedDay.Add(12 * time.Hour)
+		}
+
+		// reps belong to whichever challenge is running on the day they are credited to
+		var challengeID sql.NullInt64
+		challenge, err := s.Store.GetActiveChallenge(creditedAt.In(loc))
+		if err == sql.ErrNoRows && isBackdated {
+			logEvent(r, "bad_parse", fmt.Sprintf("no challenge on %s for backdated reps from %s", creditedAt.In(loc).Format("2006-01-02"), msg.From))
+			return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrBackdateChallengeFmt, creditedAt.In(loc).Format("Monday, Jan 2 2006"))}
+		} else if err == sql.ErrNoRows {
+			logEvent(r, "no_challenge", fmt.Sprintf("no active challenge for reps from %s", msg.From))
+		} else if err != nil {
+			logError(r, err, "unable to get active challenge")
+			return unexpectedResult(line, "unable to determine the current challenge")
+		} else {
+			for _, exercise := range exercises {
+				if !challenge.HasExercise(exercise) {
+					logEvent(r, "bad_parse", fmt.Sprintf("exercise %s not part of challenge %s", exercise, challenge.Name))
+					return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrChallengeExerciseFmt, exercise, challenge.Name, strings.Join(challenge.ExerciseNames(), ", "))}
+				}
+			}
+			challengeID = sql.NullInt64{Int64: int64(challenge.ID), Valid: true}
+		}
+		sub := &Submission{
+			UserID:     msg.UserID,
+			Sender:     msg.From,
+			To:         msg.To,
+			Subject:    msg.Subject,
+			MessageID:  msg.MessageID,
+			ReceivedAt: msg.ReceivedAt,
+			CreditedAt: creditedAt,
+			Source:     msg.Source,
+			Exercises:  exercises,
+			Counts:     counts,
+		}
+		err = s.Store.AddSubmission(sub, challengeID)
+		if err != nil {
+			logError(r, err, "unable to insert rep")
+			return unexpectedResult(line, "unable to insert into the database")
+		}
+		if isBackdated {
+			return commandResult{Line: line, Notice: fmt.Sprintf("Logged %s, credited to %s.", sub.summary(), creditedAt.In(loc).Format("Monday, Jan 2"))}
+		}
+		return commandResult{Line: line, Notice: fmt.Sprintf("Logged %s.", sub.summary())}
+	}
+
+	if isUndoSubject(line) {
+		sub, err := s.Store.GetLastSubmission(msg.From)
+		if err == sql.ErrNoRows || (err == nil && time.Since(sub.ReceivedAt) > UndoWindow) {
+			logEvent(r, "bad_undo", fmt.Sprintf("nothing to undo for %s", msg.From))
+			return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrUndoFmt, UndoWindow.Hours())}
+		} else if err != nil {
+			logError(r, err, "unable to get last submission")
+			return unexpectedResult(line, "unable to find your last submission")
+		}
+		err = s.Store.RemoveSubmission(sub)
+		if err != nil {
+			logError(r, err, "unable to remove last submission")
+			return unexpectedResult(line, "unable to remove your last submission")
+		}
+		logEvent(r, "undo", fmt.Sprintf("%s removed submission %d (%s) from %s", msg.From, sub.ID, sub.summary(), sub.ReceivedAt))
+		return commandResult{Line: line, Notice: fmt.Sprintf("Removed your submission from %s: %s.", sub.ReceivedAt.In(s.Store.GetUserLocation(msg.From)).Format("Mon Jan 2 3:04PM"), sub.summary())}
+	} else if inListCaseInsenitive(line, Offices) {
+		// offices are teams; setting your office moves you from your old office team to the new one
+		err := s.Store.SetOffice(formattedOffice(line), msg.UserID)
+		if err != nil {
+			logError(r, err, "unable to update user's office")
+			return unexpectedResult(line, "unable to update office relationship in the database")
+		}
+		return commandResult{Line: line, Notice: fmt.Sprintf("Your office is now %s.", formattedOffice(line))}
+	} else if strings.Contains(strings.ToLower(line), "team add:") {
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 {
+			logError(r, err, "enexpected error splitting subject for team add")
+			return unexpectedResult(line, "unable to add to user teams")
+		}
+		teamName := sanitizeTeamName(parts[1])
+		if inListCaseInsenitive(teamName, Offices) {
+			// you only get one office, so adding an office team is the same as setting your office
+			err = s.Store.SetOffice(formattedOffice(teamName), msg.UserID)
+		} else {
+			err = s.Store.AddTeam(teamName, msg.UserID)
+		}
+		if err != nil {
+			logError(r, err, "unable to add to user teams")
+			return unexpectedResult(line, "unable to add to user teams")
+		}
+		return commandResult{Line: line, Notice: fmt.Sprintf("You are on the %s team.", teamName)}
+	} else if strings.Contains(strings.ToLower(line), "team remove:") {
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 {
+			logError(r, err, "enexpected error splitting subject for team remove")
+			return unexpectedResult(line, "unable to add to user teams")
+		}
+		err = s.Store.RemoveTeam(sanitizeTeamName(parts[1]), msg.UserID)
+		if err != nil {
+			logError(r, err, "unable to remove from user teams")
+			return unexpectedResult(line, "unable to remove from user teams")
+		}
+		return commandResult{Line: line, Notice: fmt.Sprintf("You are off the %s team.", sanitizeTeamName(parts[1]))}
+	} else if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "timezone:") {
+		timezone := strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+		if !validTimezone(timezone) {
+			logEvent(r, "bad_parse", fmt.Sprintf("bad timezone: %s", line))
+			return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrTimezoneFmt, timezone)}
+		}
+		err = s.Store.SetUserTimezone(timezone, msg.UserID)
+		if err != nil {
+			logError(r, err, "unable to set user timezone")
+			return unexpectedResult(line, "unable to set your timezone")
+		}
+		return commandResult{Line: line, Notice: fmt.Sprintf("Your timezone is now %s.", timezone)}
+	} else if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "digest:") {
+		requested := strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+		digest, err := parseDigest(requested)
+		if err != nil {
+			logEvent(r, "bad_parse", fmt.Sprintf("bad digest: %s - %v", line, err))
+			return commandResult{Line: line, ErrMsg: fmt.Sprintf(ErrDigestFmt, requested)}
+		}
+		err = s.Store.SetUserDigest(digest, msg.UserID)
+		if err != nil {
+			logError(r, err, "unable to set user digest")
+			return unexpectedResult(line, "unable to set your digest")
+		}
+		if digest == "" {
+			return commandResult{Line: line, Notice: "You will no longer get digest emails."}
+		}
+		return commandResult{Line: line, Notice: fmt.Sprintf("You will get the %s digest, each morning after %d:00 in your timezone.", strings.Replace(digest, ",", " and ", -1), DigestHour)}
+	}
+
+	logEvent(r, "bad_parse", fmt.Sprintf("bad subject: %s", line))
+	// the hint is for the exercises in the address, or else the active challenge's, or else the whole catalog
+	exercises = msg.Exercises
+	if len(exercises) == 0 {
+		challenge, err := s.Store.GetActiveChallenge(msg.ReceivedAt)
+		if err != nil && err != sql.ErrNoRows {
+			logError(r, err, "unable to get the active challenge")
+		}
+		exercises = challenge.ExerciseNames()
+	}
+	return commandResult{Line: line, ErrMsg: subjectErrMsg(exercises, line)}
+}
+
+// summarizeResults decides the reply: an error email listing the failures if every command failed, otherwise a success email with a notice per command.
+// With a single command, the reply reads the same as before the body was parsed.
+func summarizeResults(results []commandResult) (failures []string, notices []string) {
+	if len(results) == 1 {
+		if results[0].ErrMsg != "" {
+			return []string{results[0].ErrMsg}, nil
+		}
+		if results[0].Notice != "" {
+			notices = append(notices, results[0].Notice)
+		}
+		return nil, notices
+	}
+
+	for _, result := range results {
+		if result.ErrMsg != "" {
+			failures = append(failures, fmt.Sprintf("%q: %s", result.Line, result.ErrMsg))
+			notices = append(notices, fmt.Sprintf("%q: %s", result.Line, result.ErrMsg))
+		} else {
+			notices = append(notices, fmt.Sprintf("%q: %s", result.Line, result.Notice))
+		}
+	}
+	if len(failures) == len(results) {
+		return failures, nil
+	}
+	return nil, notices
+}
@@ -19,30 +19,197 @@ func totalReps(d []RepData) int {
 	return sum
 }
 
-func populateOfficesVar(db *sql.DB) error {
-	q := "SELECT name FROM office"
-	rows, err := db.Query(q)
+// populateOfficesVar loads the office names; offices are teams of kind "office"
+func populateOfficesVar(store Store) error {
+	offices, err := store.GetOffices()
 	if err != nil {
 		return err
 	}
+	Offices = offices
+	return nil
+}
+
+// populateExercisesVar loads the active exercise catalog in display order
+func populateExercisesVar(store Store) error {
+	exercises, err := store.GetExercises()
+	if err != nil {
+		return err
+	}
+	Exercises = exercises
+	return nil
+}
+
+// GetOffices lists the names of teams that are offices
+func (s *MySQLStore) GetOffices() ([]string, error) {
+	q := "SELECT name FROM team WHERE kind=? ORDER BY name"
+	return s.queryStrings(q, TeamKindOffice)
+}
+
+// GetTeamNames lists the names of teams that are not offices
+func (s *MySQLStore) GetTeamNames() ([]string, error) {
+	q := "SELECT name FROM team WHERE kind!=? ORDER BY name"
+	return s.queryStrings(q, TeamKindOffice)
+}
+
+// GetTeamMemberTotals is each team member's total reps for the challenge, by email; members without reps have 0
+func (s *MySQLStore) GetTeamMemberTotals(c Challenge, teamName string) (map[string]int, error) {
+	totals := make(map[string]int)
+	q := "SELECT user.email, COALESCE(SUM(reps.count), 0) FROM user_team JOIN team ON user_team.team_id=team.id JOIN user ON user_team.user_id=user.id LEFT JOIN reps ON reps.user_id=user.id AND reps.challenge_id=? WHERE team.name=? GROUP BY user.email"
+	rows, err := s.DB.Query(q, c.ID, teamName)
+	if err != nil {
+		return nil, errors.Wrap(err, queryPrinter(q, c.ID, teamName))
+	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var office string
-		err = rows.Scan(&office)
+		var email string
+		var total int
+		err = rows.Scan(&email, &total)
 		if err != nil {
-			return err
+			return nil, errors.Wrap(err, queryPrinter(q, c.ID, teamName))
 		}
-		if office != "" {
-			Offices = append(Offices, office)
+		totals[email] = total
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return totals, nil
+}
+
+// GetExercises lists the active exercise catalog in display order
+func (s *MySQLStore) GetExercises() ([]Exercise, error) {
+	q := "SELECT id, name, aliases, display_order, active FROM exercise WHERE active=1 ORDER BY display_order, id"
+	rows, err := s.DB.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, queryPrinter(q))
+	}
+	defer rows.Close()
+
+	var exercises []Exercise
+	for rows.Next() {
+		var e Exercise
+		var aliases string
+		err = rows.Scan(&e.ID, &e.Name, &aliases, &e.DisplayOrder, &e.Active)
+		if err != nil {
+			return nil, err
+		}
+		for _, alias := range strings.Split(aliases, ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				e.Aliases = append(e.Aliases, alias)
+			}
+		}
+		exercises = append(exercises, e)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return exercises, nil
+}
+
+// GetChallenges lists every challenge, most recent first
+func (s *MySQLStore) GetChallenges() ([]Challenge, error) {
+	var challenges []Challenge
+	q := "SELECT id, name, start_date, end_date FROM challenge ORDER BY start_date DESC"
+	rows, err := s.DB.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, queryPrinter(q))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Challenge
+		err = rows.Scan(&c.ID, &c.Name, &c.StartDate, &c.EndDate)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to scan challenges")
 		}
+		challenges = append(challenges, c)
 	}
 	if rows.Err() != nil {
-		return rows.Err()
+		return nil, rows.Err()
+	}
+
+	for i := range challenges {
+		err = s.populateChallengeDetails(&challenges[i])
+		if err != nil {
+			return nil, err
+		}
 	}
+	return challenges, nil
+}
+
+// GetChallenge finds the challenge by name
+func (s *MySQLStore) GetChallenge(name string) (Challenge, error) {
+	q := "SELECT id, name, start_date, end_date FROM challenge WHERE name=? LIMIT 1"
+	return s.queryChallenge(q, strings.TrimSpace(name))
+}
+
+// GetActiveChallenge finds the challenge running at t. New reps are attributed to this challenge.
+func (s *MySQLStore) GetActiveChallenge(t time.Time) (Challenge, error) {
+	day := t.Format("2006-01-02")
+	q := "SELECT id, name, start_date, end_date FROM challenge WHERE start_date <= ? AND end_date >= ? ORDER BY start_date DESC LIMIT 1"
+	return s.queryChallenge(q, day, day)
+}
+
+// GetCurrentChallenge finds the challenge to show by default: the active one, or else the most recently started one
+func (s *MySQLStore) GetCurrentChallenge(t time.Time) (Challenge, error) {
+	q := "SELECT id, name, start_date, end_date FROM challenge WHERE start_date <= ? ORDER BY start_date DESC LIMIT 1"
+	return s.queryChallenge(q, t.Format("2006-01-02"))
+}
+
+// queryChallenge runs a query selecting a single challenge and fills in its exercises and teams
+func (s *MySQLStore) queryChallenge(q string, args ...interface{}) (Challenge, error) {
+	var c Challenge
+	row := s.DB.QueryRow(q, args...)
+	err := row.Scan(&c.ID, &c.Name, &c.StartDate, &c.EndDate)
+	if err == sql.ErrNoRows {
+		return c, err
+	} else if err != nil {
+		return c, errors.Wrap(err, queryPrinter(q, args...))
+	}
+	err = s.populateChallengeDetails(&c)
+	return c, err
+}
+
+// populateChallengeDetails fills in the exercises and participating teams for the challenge
+func (s *MySQLStore) populateChallengeDetails(c *Challenge) error {
+	qExercises := "SELECT exercise.name FROM challenge_exercise JOIN exercise ON challenge_exercise.exercise_id=exercise.id WHERE challenge_exercise.challenge_id=? ORDER BY exercise.display_order, exercise.id"
+	exercises, err := s.queryStrings(qExercises, c.ID)
+	if err != nil {
+		return err
+	}
+	qTeams := "SELECT team.name FROM challenge_team JOIN team ON challenge_team.team_id=team.id WHERE challenge_team.challenge_id=? ORDER BY team.name"
+	teams, err := s.queryStrings(qTeams, c.ID)
+	if err != nil {
+		return err
+	}
+	c.Exercises = exercises
+	c.Teams = teams
 	return nil
 }
 
+// queryStrings is a helper for queries that select a single string column
+func (s *MySQLStore) queryStrings(q string, args ...interface{}) ([]string, error) {
+	var list []string
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, queryPrinter(q, args...))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var str string
+		err = rows.Scan(&str)
+		if err != nil {
+			return nil, errors.Wrap(err, queryPrinter(q, args...))
+		}
+		list = append(list, str)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return list, nil
+}
+
 func formattedOffice(s string) string {
 	for _, office := range Offices {
 		if strings.ToLower(office) == strings.TrimSpace(strings.ToLower(s)) {
@@ -64,16 +231,16 @@ func inListCaseInsenitive(s string, list []string) bool {
 	return false
 }
 
-func getOrCreateUserID(db *sql.DB, email string) (int, error) {
+func (s *MySQLStore) GetOrCreateUserID(email string) (int, error) {
 	var id int
 	getQ := "SELECT id FROM user WHERE email=? LIMIT 1"
-	row := db.QueryRow(getQ, email)
+	row := s.DB.QueryRow(getQ, email)
 	err := row.Scan(&id)
 	if err != nil && err != sql.ErrNoRows {
 		return 0, errors.Wrap(err, queryPrinter(getQ, email))
 	} else if err == sql.ErrNoRows {
-		q := "INSERT INTO user (email, office) VALUES (?, (SELECT id from office where name=\"\"))"
-		res, err := db.Exec(q, email)
+		q := "INSERT INTO user (email) VALUES (?)"
+		res, err := s.DB.Exec(q, email)
 		if err != nil {
 			return 0, errors.Wrap(err, queryPrinter(q, email))
 		}
@@ -87,33 +254,69 @@ func getOrCreateUserID(db *sql.DB, email string) (int, error) {
 	return id, nil
 }
 
-// TODO: expand the office table to have timezone info
-// Alternative: don't use NOW(), use unix timestamp
-func timezoneShift(office string) time.Duration {
-	// timezone on server is set to my local America/Los_Angeles
-	switch office {
-	case "Denver":
-		return time.Hour * 1
-	case "Romania":
-		return time.Hour * 9
-	case "NY":
-		return time.Hour * 3
-	case "London":
-		return time.Hour * 7
+// GetUserLocation is the user's timezone; without one, it defaults from their office team, then their other teams, then DefaultTimezone
+func (s *MySQLStore) GetUserLocation(email string) *time.Location {
+	q := "SELECT user.timezone, team.timezone FROM user LEFT JOIN user_team ON user_team.user_id=user.id LEFT JOIN team ON user_team.team_id=team.id WHERE user.email=? ORDER BY team.kind=? DESC, team.id"
+	rows, err := s.DB.Query(q, email, TeamKindOffice)
+	if err != nil {
+		logError(nil, errors.Wrap(err, queryPrinter(q, email, TeamKindOffice)), "unable to query for user timezone")
+		return loadLocation("")
+	}
+	defer rows.Close()
+
+	var teamTimezone string
+	for rows.Next() {
+		var userTZ, teamTZ sql.NullString
+		err = rows.Scan(&userTZ, &teamTZ)
+		if err != nil {
+			logError(nil, errors.Wrap(err, queryPrinter(q, email, TeamKindOffice)), "unable to scan user timezone")
+			break
+		}
+		if userTZ.String != "" {
+			return loadLocation(userTZ.String)
+		}
+		if teamTimezone == "" {
+			teamTimezone = teamTZ.String
+		}
+	}
+	if rows.Err() != nil {
+		logError(nil, rows.Err(), "error after rows.Next in getUserLocation")
+	}
+	return loadLocation(teamTimezone)
+}
+
+// SetUserTimezone stores the user's IANA timezone
+func (s *MySQLStore) SetUserTimezone(timezone string, userID int) error {
+	q := "UPDATE user SET timezone=? WHERE id=?"
+	_, err := s.DB.Exec(q, timezone, userID)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, timezone, userID))
 	}
+	return nil
+}
 
-	return time.Duration(0)
+// SetUserDigest sets the digests the user opted in to, ie, "daily,weekly"; empty turns them off
+func (s *MySQLStore) SetUserDigest(digest string, userID int) error {
+	q := "UPDATE user SET digest=? WHERE id=?"
+	_, err := s.DB.Exec(q, digest, userID)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, digest, userID))
+	}
+	return nil
 }
 
-// getTodaysReps will only grab the latest N submissions
-func getTodaysReps(db *sql.DB, email string) []RepData {
+// GetTodaysReps will only grab the latest N submissions
+func (s *MySQLStore) GetTodaysReps(email string) []RepData {
 	var rd []RepData
 	limit := 11
-	q := fmt.Sprintf("SELECT reps.exercise, reps.count, reps.created_at, office.name FROM reps JOIN user on reps.user_id=user.id JOIN office on user.office=office.id WHERE user.email=? AND created_at >= ? ORDER BY created_at DESC LIMIT %d", limit)
-	rows, err := db.Query(q, email, fmt.Sprintf("%d-%d-%d", time.Now().Year(), int(time.Now().Month()), time.Now().Day()))
-	logDebug(nil, queryPrinter(q, email, fmt.Sprintf("%d-%d-%d", time.Now().Year(), int(time.Now().Month()), time.Now().Day())))
+	// "today" starts at midnight where the user is, not where the server is
+	loc := s.GetUserLocation(email)
+	today := startOfDay(time.Now(), loc).UTC()
+	q := fmt.Sprintf("SELECT reps.exercise, reps.count, reps.created_at FROM reps JOIN user on reps.user_id=user.id WHERE user.email=? AND created_at >= ? ORDER BY created_at DESC LIMIT %d", limit)
+	rows, err := s.DB.Query(q, email, today)
+	logDebug(nil, queryPrinter(q, email, today))
 	if err != nil {
-		logError(nil, errors.Wrap(err, queryPrinter(q, email, fmt.Sprintf("%d-%d-%d", time.Now().Year(), int(time.Now().Month()), time.Now().Day()))), "unable to get today's reps")
+		logError(nil, errors.Wrap(err, queryPrinter(q, email, today)), "unable to get today's reps")
 		return rd
 	}
 	defer rows.Close()
@@ -122,13 +325,12 @@ func getTodaysReps(db *sql.DB, email string) []RepData {
 		var exercise string
 		var count int
 		var createdAt time.Time
-		var office string
-		err := rows.Scan(&exercise, &count, &createdAt, &office)
+		err := rows.Scan(&exercise, &count, &createdAt)
 		if err != nil {
-			logError(nil, errors.Wrap(err, queryPrinter(q, email, fmt.Sprintf("%d-%d-%d", time.Now().Year(), int(time.Now().Month()), time.Now().Day()))), "unable to scan today's reps")
+			logError(nil, errors.Wrap(err, queryPrinter(q, email, today)), "unable to scan today's reps")
 		}
 		rd = append(rd, RepData{
-			Date:           createdAt.Add(timezoneShift(office)).Format(time.Kitchen),
+			Date:           createdAt.In(loc).Format(time.Kitchen),
 			ExerciseCounts: map[string]int{exercise: count},
 		})
 	}
@@ -142,25 +344,26 @@ func getTodaysReps(db *sql.DB, email string) []RepData {
 	return rd
 }
 
-func getUserOffice(db *sql.DB, email string) string {
-	// leverage the empty value; there is a "" value in the office table
+// GetUserOffice gives the name of the user's office team, or "" if they have not set one
+func (s *MySQLStore) GetUserOffice(email string) string {
 	var officeName string
-	q := "SELECT office.name FROM user JOIN office ON user.office=office.id WHERE user.email=?"
-	row := db.QueryRow(q, email)
+	q := "SELECT team.name FROM team JOIN user_team ON user_team.team_id=team.id JOIN user ON user_team.user_id=user.id WHERE user.email=? AND team.kind=? LIMIT 1"
+	row := s.DB.QueryRow(q, email, TeamKindOffice)
 	err := row.Scan(&officeName)
 	if err != nil && err != sql.ErrNoRows {
-		logError(nil, errors.Wrap(err, queryPrinter(q, email)), "unable to query for office name")
+		logError(nil, errors.Wrap(err, queryPrinter(q, email, TeamKindOffice)), "unable to query for office name")
 		return ""
 	}
 	return officeName
 }
 
-func getUserTeams(db *sql.DB, email string) []string {
+// GetUserTeams lists the user's teams, not including their office (see GetUserOffice)
+func (s *MySQLStore) GetUserTeams(email string) []string {
 	var teams []string
-	q := "SELECT team.name FROM team WHERE team.id in (SELECT user_team.team_id FROM user_team JOIN user ON user_team.user_id=user.id WHERE user.email=?);"
-	rows, err := db.Query(q, email)
+	q := "SELECT team.name FROM team WHERE team.kind!=? AND team.id in (SELECT user_team.team_id FROM user_team JOIN user ON user_team.user_id=user.id WHERE user.email=?);"
+	rows, err := s.DB.Query(q, TeamKindOffice, email)
 	if err != nil {
-		logError(nil, errors.Wrap(err, queryPrinter(q, email)), "unable to query for user teams")
+		logError(nil, errors.Wrap(err, queryPrinter(q, TeamKindOffice, email)), "unable to query for user teams")
 		return teams
 	}
 	defer rows.Close()
@@ -169,7 +372,7 @@ func getUserTeams(db *sql.DB, email string) []string {
 		var name string
 		err := rows.Scan(&name)
 		if err != nil {
-			logError(nil, errors.Wrap(err, queryPrinter(q, email)), "unable to scan query for user teams")
+			logError(nil, errors.Wrap(err, queryPrinter(q, TeamKindOffice, email)), "unable to scan query for user teams")
 			return teams
 		}
 		teams = append(teams, name)
@@ -181,11 +384,11 @@ func getUserTeams(db *sql.DB, email string) []string {
 	return teams
 }
 
-func getTeamID(db *sql.DB, teamName string, createIfMissing bool) (int, error) {
+func (s *MySQLStore) getTeamID(teamName string, createIfMissing bool) (int, error) {
 	var id int
 	teamName = strings.TrimSpace(teamName)
 	q := "SELECT id FROM team WHERE name=? LIMIT 1"
-	rows, err := db.Query(q, teamName)
+	rows, err := s.DB.Query(q, teamName)
 	if err != nil {
 		return 0, errors.Wrapf(err, "unable to scan team id for %q", teamName)
 	}
@@ -204,7 +407,7 @@ func getTeamID(db *sql.DB, teamName string, createIfMissing bool) (int, error) {
 	}
 
 	if id == 0 && createIfMissing {
-		res, err := db.Exec("INSERT INTO team SET name=?", teamName)
+		res, err := s.DB.Exec("INSERT INTO team (name) VALUES (?)", teamName)
 		if err != nil {
 			return 0, errors.Wrapf(err, "unable to insert team id for %q", teamName)
 		}
@@ -218,19 +421,19 @@ func getTeamID(db *sql.DB, teamName string, createIfMissing bool) (int, error) {
 	return 0, sql.ErrNoRows
 }
 
-func addTeam(db *sql.DB, teamName string, userID int) error {
+func (s *MySQLStore) AddTeam(teamName string, userID int) error {
 	teamName = strings.TrimSpace(teamName)
-	teamID, err := getTeamID(db, teamName, true)
+	teamID, err := s.getTeamID(teamName, true)
 	if err != nil {
 		return err
 	}
 
-	if isOnTeam(db, teamName, userID) {
+	if s.isOnTeam(teamName, userID) {
 		return nil
 	}
 
 	q := "INSERT INTO user_team (user_id, team_id) VALUES (?,?)"
-	_, err = db.Exec(q, userID, teamID)
+	_, err = s.DB.Exec(q, userID, teamID)
 	if err != nil {
 		return errors.Wrap(err, queryPrinter(q, userID, teamID))
 	}
@@ -238,9 +441,30 @@ func addTeam(db *sql.DB, teamName string, userID int) error {
 	return nil
 }
 
-func isOnTeam(db *sql.DB, teamName string, userID int) bool {
+// SetOffice puts the user on the office's team and takes them off any other office; a user has at most one office
+func (s *MySQLStore) SetOffice(officeName string, userID int) error {
+	teamID, err := s.getTeamID(officeName, false)
+	if err != nil {
+		return errors.Wrapf(err, "unable to find office %q", officeName)
+	}
+
+	q := "DELETE FROM user_team WHERE user_id=? AND team_id IN (SELECT id FROM team WHERE kind=?)"
+	_, err = s.DB.Exec(q, userID, TeamKindOffice)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, userID, TeamKindOffice))
+	}
+
+	q = "INSERT INTO user_team (user_id, team_id) VALUES (?,?)"
+	_, err = s.DB.Exec(q, userID, teamID)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, userID, teamID))
+	}
+	return nil
+}
+
+func (s *MySQLStore) isOnTeam(teamName string, userID int) bool {
 	q := "SELECT count(*) FROM user_team WHERE user_team.team_id=(SELECT id FROM team WHERE name=?) AND user_team.user_id=?"
-	rows, err := db.Query(q, teamName, userID)
+	rows, err := s.DB.Query(q, teamName, userID)
 	if err != nil {
 		logError(nil, errors.Wrap(err, queryPrinter(q, teamName, userID)), "unable to check for team membership")
 		return false
@@ -259,14 +483,14 @@ func isOnTeam(db *sql.DB, teamName string, userID int) bool {
 	return count > 0
 }
 
-func removeTeam(db *sql.DB, teamName string, userID int) error {
+func (s *MySQLStore) RemoveTeam(teamName string, userID int) error {
 	teamName = strings.TrimSpace(teamName)
-	teamID, err := getTeamID(db, teamName, false)
+	teamID, err := s.getTeamID(teamName, false)
 	if err != nil {
 		return err
 	}
 	q := "DELETE FROM user_team WHERE user_id=? AND team_id=?"
-	_, err = db.Exec(q, userID, teamID)
+	_, err = s.DB.Exec(q, userID, teamID)
 	if err != nil {
 		return errors.Wrap(err, queryPrinter(q, userID, teamID))
 	}
@@ -274,18 +498,21 @@ func removeTeam(db *sql.DB, teamName string, userID int) error {
 	return nil
 }
 
-func getTeamStats(db *sql.DB) map[string]Stats {
+func (s *MySQLStore) GetTeamStats(c Challenge) map[string]Stats {
 	teamStats := make(map[string]Stats)
-	teams := getTeams(db)
+	teams := s.getTeams()
 	for _, team := range teams {
+		if !c.HasTeam(team.name) {
+			continue
+		}
 		teamName := team.name
 		teamID := team.id
-		var participating int // does not make sense for teams really; you are registered for the team otherwise you would not get a stat for it
+		var participating int
 		var headCount int
 		var totalReps sql.NullInt64
 
 		qHeadCount := "SELECT count(*) FROM user_team WHERE user_team.team_id=?"
-		row := db.QueryRow(qHeadCount, teamID)
+		row := s.DB.QueryRow(qHeadCount, teamID)
 		err := row.Scan(&headCount)
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -294,24 +521,36 @@ func getTeamStats(db *sql.DB) map[string]Stats {
 			logError(nil, errors.Wrap(err, queryPrinter(qHeadCount, teamName)), "unable to scan for team head count")
 		}
 
-		// TODO: is there a better way to measure team participation, or does that not make sense? Works for offices, not so much teams.
-		participating = headCount
+		if team.kind == TeamKindOffice {
+			// offices know their real head count; participation is whoever in the office logged reps
+			if team.headCount.Valid {
+				headCount = int(team.headCount.Int64)
+			}
+			qParticip := "SELECT count(DISTINCT reps.user_id) FROM reps JOIN user_team ON reps.user_id=user_team.user_id WHERE user_team.team_id=? AND reps.challenge_id=?"
+			row = s.DB.QueryRow(qParticip, teamID, c.ID)
+			err = row.Scan(&participating)
+			if err != nil {
+				logError(nil, errors.Wrap(err, queryPrinter(qParticip, teamID, c.ID)), "unable to scan for office participation")
+				return teamStats
+			}
+		} else {
+			// TODO: is there a better way to measure team participation, or does that not make sense? Works for offices, not so much teams.
+			// does not make sense for teams really; you are registered for the team otherwise you would not get a stat for it
+			participating = headCount
+		}
 
-		qTotals := "select sum(reps.count) from reps where reps.created_at > ? and reps.created_at < ? and reps.user_id in (SELECT DISTINCT user_id FROM user_team WHERE team_id=?)"
-		row = db.QueryRow(qTotals, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"), teamID)
+		qTotals := "select sum(reps.count) from reps where reps.challenge_id=? and reps.user_id in (SELECT DISTINCT user_id FROM user_team WHERE team_id=?)"
+		row = s.DB.QueryRow(qTotals, c.ID, teamID)
 		err = row.Scan(&totalReps)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				continue
 			}
-			logError(nil, errors.Wrap(err, queryPrinter(qTotals, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"), teamID)), "unable to scan for office totals")
+			logError(nil, errors.Wrap(err, queryPrinter(qTotals, c.ID, teamID)), "unable to scan for office totals")
 			return teamStats
 		}
 
-		totalDays := int(EndDate.Sub(StartDate).Hours() / float64(24))
-		if totalDays <= 0 {
-			totalDays = 1 // avoid divide by zero
-		}
+		totalDays := c.totalDays()
 
 		if headCount == 0 {
 			headCount = 1 // avoid divide by zero
@@ -334,81 +573,36 @@ func getTeamStats(db *sql.DB) map[string]Stats {
 	return teamStats
 }
 
-func getOfficeStats(db *sql.DB) map[string]Stats {
-	officeStats := make(map[string]Stats)
-	for _, officeName := range Offices {
-		var headCount int
-		var participating int
-		var totalReps sql.NullInt64
-
-		qHeadCount := "SELECT head_count FROM office WHERE office.name=?"
-		row := db.QueryRow(qHeadCount, officeName)
-		err := row.Scan(&headCount)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			}
-			logError(nil, errors.Wrap(err, queryPrinter(qHeadCount, officeName)), "unable to scan for office head count")
-		}
-
-		qParticip := "SELECT count(distinct id) from (SELECT user.id FROM reps JOIN user on reps.user_id=user.id JOIN office ON user.office=office.id WHERE office.name=? and reps.created_at > ? AND reps.created_at < ?) participating;"
-		row = db.QueryRow(qParticip, officeName, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))
-		err = row.Scan(&participating)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			}
-			logError(nil, errors.Wrap(err, queryPrinter(qParticip, officeName, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))), "unable to scan for office participation")
-			return officeStats
-		}
-
-		qTotals := "select sum(reps.count) from reps left join user on reps.user_id=user.id join office on office.id=user.office where reps.created_at > ? and reps.created_at < ? and office.name=?;"
-		row = db.QueryRow(qTotals, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"), officeName)
-		err = row.Scan(&totalReps)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			}
-			logError(nil, errors.Wrap(err, queryPrinter(qTotals, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"), officeName)), "unable to scan for office totals")
-			return officeStats
-		}
-
-		totalDays := int(EndDate.Sub(StartDate).Hours() / float64(24))
-		if totalDays <= 0 {
-			totalDays = 1 // avoid divide by zero
-		}
+// Team kinds; offices are teams of kind office
+const (
+	TeamKindTeam   = "team"
+	TeamKindOffice = "office"
+)
 
-		if headCount == 0 {
-			headCount = 1 // avoid divide by zero
-		}
-		stats := Stats{}
-		stats.HeadCount = headCount
-		stats.TotalReps = int(totalReps.Int64)
-		stats.PercentParticipating = participating * 100 / headCount
-		stats.RepsPerPerson = int(totalReps.Int64) / headCount
+// Team represents the db reference to a given team to which a user can have many
+type Team struct {
+	id        int
+	name      string
+	kind      string
+	headCount sql.NullInt64
+	timezone  sql.NullString
+}
 
-		if participating == 0 {
-			participating = 1 // avoid divide by zero
+// GetOfficeStats is the subset of team stats for teams that are offices
+func (s *MySQLStore) GetOfficeStats(c Challenge) map[string]Stats {
+	officeStats := make(map[string]Stats)
+	for teamName, stats := range s.GetTeamStats(c) {
+		if inListCaseInsenitive(teamName, Offices) {
+			officeStats[teamName] = stats
 		}
-		stats.RepsPerPersonParticipating = int(totalReps.Int64) / participating
-		stats.RepsPerPersonParticipatingPerDay = int(totalReps.Int64) / participating / totalDays
-		stats.RepsPerPersonPerDay = int(totalReps.Int64) / headCount / totalDays
-
-		officeStats[officeName] = stats
 	}
 	return officeStats
 }
 
-// Team represents the db reference to a given team to which a user can have many
-type Team struct {
-	id   int
-	name string
-}
-
-func getTeams(db *sql.DB) []Team {
+func (s *MySQLStore) getTeams() []Team {
 	var teams []Team
-	q := "SELECT id, name FROM team"
-	rows, err := db.Query(q)
+	q := "SELECT id, name, kind, head_count, timezone FROM team"
+	rows, err := s.DB.Query(q)
 	if err != nil {
 		logError(nil, errors.Wrap(err, queryPrinter(q)), "unable to query teams")
 		return teams
@@ -416,13 +610,15 @@ func getTeams(db *sql.DB) []Team {
 	defer rows.Close()
 
 	for rows.Next() {
-		var name string
+		var name, kind string
 		var id int
-		err := rows.Scan(&id, &name)
+		var headCount sql.NullInt64
+		var timezone sql.NullString
+		err := rows.Scan(&id, &name, &kind, &headCount, &timezone)
 		if err != nil {
 			logError(nil, errors.Wrap(err, queryPrinter(q)), "unable to scan teams")
 		}
-		teams = append(teams, Team{id: id, name: name})
+		teams = append(teams, Team{id: id, name: name, kind: kind, headCount: headCount, timezone: timezone})
 	}
 	if rows.Err() != nil {
 		logError(nil, errors.Wrap(err, queryPrinter(q)), "post scan error for teams")
@@ -430,32 +626,36 @@ func getTeams(db *sql.DB) []Team {
 	return teams
 }
 
-func getTeamReps(db *sql.DB) map[string][]RepData {
+func (s *MySQLStore) GetTeamReps(c Challenge) map[string][]RepData {
 	trd := make(map[string][]RepData)
-	teams := getTeams(db)
-	// TODO: DRY up with getOfficeReps
+	teams := s.getTeams()
 	for _, team := range teams {
-		q := "SELECT reps.exercise, reps.count, reps.created_at FROM reps JOIN user on reps.user_id=user.id WHERE user.id in (SELECT DISTINCT user_id FROM user_team WHERE user_team.team_id=?) AND reps.created_at > ? AND reps.created_at < ?"
-		rows, err := db.Query(q, team.id, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))
+		if !c.HasTeam(team.name) {
+			continue
+		}
+		q := "SELECT reps.exercise, reps.count, reps.created_at FROM reps JOIN user on reps.user_id=user.id WHERE user.id in (SELECT DISTINCT user_id FROM user_team WHERE user_team.team_id=?) AND reps.challenge_id=?"
+		rows, err := s.DB.Query(q, team.id, c.ID)
 		if err != nil {
-			logError(nil, errors.Wrap(err, queryPrinter(q, team.id, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))), "unable to query for user's reps")
+			logError(nil, errors.Wrap(err, queryPrinter(q, team.id, c.ID)), "unable to query for user's reps")
 			return nil
 		}
 		defer rows.Close()
 
-		repDatas := initRepData()
+		// daily buckets are in the team's timezone
+		loc := loadLocation(team.timezone.String)
+		repDatas := initRepData(c)
 		for rows.Next() {
 			var exercise string
 			var count int
 			var createdAt time.Time
 			err = rows.Scan(&exercise, &count, &createdAt)
 			if err != nil {
-				logError(nil, errors.Wrap(err, queryPrinter(q, team.id, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))), "unable to scan results for user's reps")
+				logError(nil, errors.Wrap(err, queryPrinter(q, team.id, c.ID)), "unable to scan results for user's reps")
 				return nil
 			}
 			for _, rd := range repDatas {
 				// find which repData slot we need to populate. Probably more effecient way to do this. Probably a fancy mysql query could have done all this for me.
-				if rd.Date != fmt.Sprintf("%d-%d", int(createdAt.Month()), createdAt.Day()) {
+				if rd.Date != dayKey(createdAt, loc) {
 					continue
 				}
 				rd.ExerciseCounts[exercise] += count
@@ -469,70 +669,30 @@ func getTeamReps(db *sql.DB) map[string][]RepData {
 	return trd
 }
 
-func getOfficeReps(db *sql.DB) map[string][]RepData {
-	// DEBUG
-	_ = getTeamReps(db)
-	// END DEBUG
-
-	officeReps := make(map[string][]RepData)
-	// TODO: DRY it up getUserReps
-	for _, officeName := range Offices {
-		q := "SELECT reps.exercise, reps.count, reps.created_at FROM reps JOIN user on reps.user_id=user.id WHERE user.id in (SELECT user.id FROM user JOIN office on user.office=office.id WHERE office.name=?) AND reps.created_at > ? AND reps.created_at < ?"
-		rows, err := db.Query(q, officeName, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))
-		if err != nil {
-			logError(nil, errors.Wrap(err, queryPrinter(q, officeName, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))), "unable to query for user's reps")
-			return nil
-		}
-		defer rows.Close()
-
-		repDatas := initRepData()
-		for rows.Next() {
-			var exercise string
-			var count int
-			var createdAt time.Time
-			err = rows.Scan(&exercise, &count, &createdAt)
-			if err != nil {
-				logError(nil, errors.Wrap(err, queryPrinter(q, officeName, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))), "unable to scan results for user's reps")
-				return nil
-			}
-			for _, rd := range repDatas {
-				// find which repData slot we need to populate. Probably more effecient way to do this. Probably a fancy mysql query could have done all this for me.
-				if rd.Date != fmt.Sprintf("%d-%d", int(createdAt.Month()), createdAt.Day()) {
-					continue
-				}
-				rd.ExerciseCounts[exercise] += count
-			}
-		}
-		if rows.Err() != nil {
-			logError(nil, rows.Err(), "error after parsing data for user reps")
-		}
-		officeReps[officeName] = repDatas
-	}
-	return officeReps
-}
-
-func getUserReps(db *sql.DB, email string) []RepData {
-	q := "SELECT reps.exercise, reps.count, reps.created_at FROM reps JOIN user on reps.user_id=user.id WHERE email=? AND reps.created_at > ? AND reps.created_at < ?"
-	rows, err := db.Query(q, email, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))
+func (s *MySQLStore) GetUserReps(c Challenge, email string) []RepData {
+	q := "SELECT reps.exercise, reps.count, reps.created_at FROM reps JOIN user on reps.user_id=user.id WHERE email=? AND reps.challenge_id=?"
+	rows, err := s.DB.Query(q, email, c.ID)
 	if err != nil {
-		logError(nil, errors.Wrap(err, queryPrinter(q, email, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))), "unable to query for user's reps")
+		logError(nil, errors.Wrap(err, queryPrinter(q, email, c.ID)), "unable to query for user's reps")
 		return nil
 	}
 	defer rows.Close()
 
-	repDatas := initRepData()
+	// daily buckets are in the user's timezone
+	loc := s.GetUserLocation(email)
+	repDatas := initRepData(c)
 	for rows.Next() {
 		var exercise string
 		var count int
 		var createdAt time.Time
 		err = rows.Scan(&exercise, &count, &createdAt)
 		if err != nil {
-			logError(nil, errors.Wrap(err, queryPrinter(q, email, StartDate.Format("2006-01-02"), EndDate.Format("2006-01-02"))), "unable to scan results for user's reps")
+			logError(nil, errors.Wrap(err, queryPrinter(q, email, c.ID)), "unable to scan results for user's reps")
 			return nil
 		}
 		for _, rd := range repDatas {
 			// find which repData slot we need to populate. Probably more effecient way to do this. Probably a fancy mysql query could have done all this for me.
-			if rd.Date != fmt.Sprintf("%d-%d", int(createdAt.Month()), createdAt.Day()) {
+			if rd.Date != dayKey(createdAt, loc) {
 				continue
 			}
 			rd.ExerciseCounts[exercise] += count
@@ -544,18 +704,28 @@ func getUserReps(db *sql.DB, email string) []RepData {
 	return repDatas
 }
 
-func initRepData() []RepData {
+func initRepData(c Challenge) []RepData {
 	var rd []RepData
-	for cur := StartDate; cur.Before(EndDate.Add(time.Hour * 24)); cur = cur.Add(time.Hour * 24) {
+	// the challenge dates are calendar days, so step by day rather than 24 hours
+	for cur := c.StartDate; !cur.After(c.EndDate); cur = cur.AddDate(0, 0, 1) {
 		rd = append(
 			rd, RepData{
 				Date:           fmt.Sprintf("%d-%d", int(cur.Month()), cur.Day()),
-				ExerciseCounts: make(map[string]int),
+				ExerciseCounts: initExerciseCounts(c),
 			})
 	}
 	return rd
 }
 
+// initExerciseCounts zeros out each exercise in the challenge so every exercise shows up, even without reps
+func initExerciseCounts(c Challenge) map[string]int {
+	counts := make(map[string]int)
+	for _, name := range c.ExerciseNames() {
+		counts[name] = 0
+	}
+	return counts
+}
+
 func queryPrinter(q string, args ...interface{}) string {
 	qFmt := strings.Replace(q, "?", `"%v"`, -1)
 	return fmt.Sprintf(qFmt, args...)
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Digest kinds, as sent in "Digest: daily, weekly"
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// DigestHour is the hour, in each user's timezone, after which that day's digests are sent
+var DigestHour = 7
+
+// DigestWeekday is when the weekly digest is sent; it covers the 7 days before
+var DigestWeekday = time.Monday
+
+// digestLeaderboardSize is how many teams the weekly leaderboard lists, besides the user's own
+const digestLeaderboardSize = 10
+
+// DigestUser is a user who opted in to at least one digest
+type DigestUser struct {
+	ID    int
+	Email string
+	// Digest is the kinds opted in to, ie, "daily,weekly"
+	Digest string
+	// Location is the user's timezone, defaulted from their teams like GetUserLocation
+	Location *time.Location
+}
+
+// wants reports if the user opted in to the kind of digest
+func (u DigestUser) wants(kind string) bool {
+	for _, k := range strings.Split(u.Digest, ",") {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDigest reads the part after "Digest:", ie, "daily", "Weekly", "daily, weekly", or "off", into the form stored for the user.
+// Off is stored as empty.
+func parseDigest(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "off" || s == "none" {
+		return "", nil
+	}
+	var daily, weekly bool
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		switch word {
+		case DigestDaily:
+			daily = true
+		case DigestWeekly:
+			weekly = true
+		case "both":
+			daily, weekly = true, true
+		case "and":
+		default:
+			return "", fmt.Errorf("unknown digest %q", word)
+		}
+	}
+	var kinds []string
+	if daily {
+		kinds = append(kinds, DigestDaily)
+	}
+	if weekly {
+		kinds = append(kinds, DigestWeekly)
+	}
+	if len(kinds) == 0 {
+		return "", fmt.Errorf("no digest in %q", s)
+	}
+	return strings.Join(kinds, ","), nil
+}
+
+// DigestScheduler is the background worker that sends the opted in digests once each user's DigestHour passes.
+// Each digest is recorded before it is sent, so it goes out at most once even with more than one server running.
+type DigestScheduler struct {
+	Server *Server
+	// PollInterval is how often to look for digests to send
+	PollInterval time.Duration
+
+	close chan struct{}
+}
+
+// NewDigestScheduler creates a worker that sends digests with the server's store and EmailSender
+func NewDigestScheduler(s *Server) *DigestScheduler {
+	return &DigestScheduler{
+		Server:       s,
+		PollInterval: 5 * time.Minute,
+		close:        make(chan struct{}),
+	}
+}
+
+// Run sends due digests every PollInterval until Close
+func (d *DigestScheduler) Run() {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.SendDue(time.Now()); err != nil {
+			logError(nil, err, "unable to send digests")
+		}
+		select {
+		case <-d.close:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops Run
+func (d *DigestScheduler) Close() error {
+	close(d.close)
+	return nil
+}
+
+// SendDue sends each opted in user the digests due as of now in their timezone, and returns how many were sent.
+// A daily digest is due for yesterday if a challenge was running then, and a weekly one on DigestWeekday if the past week overlapped a challenge.
+func (d *DigestScheduler) SendDue(now time.Time) (int, error) {
+	users, err := d.Server.Store.GetDigestUsers()
+	if err != nil {
+		return 0, err
+	}
+	var sent int
+	for _, u := range users {
+		local := now.In(u.Location)
+		if local.Hour() < DigestHour {
+			continue
+		}
+		today := startOfDay(now, u.Location)
+
+		if u.wants(DigestDaily) {
+			ok, err := d.Server.SendDailyDigest(u, today)
+			if err != nil {
+				logError(nil, err, fmt.Sprintf("unable to send daily digest to %s", u.Email))
+			} else if ok {
+				sent++
+			}
+		}
+		if u.wants(DigestWeekly) && local.Weekday() == DigestWeekday {
+			ok, err := d.Server.SendWeeklyDigest(u, today)
+			if err != nil {
+				logError(nil, err, fmt.Sprintf("unable to send weekly digest to %s", u.Email))
+			} else if ok {
+				sent++
+			}
+		}
+	}
+	return sent, nil
+}
+
+// dailyDigest is the data for digest_daily.html and digest_daily.txt
+type dailyDigest struct {
+	Challenge string
+	Day       string
+	Total     int
+	Breakdown []exerciseCount
+	// Teams is where each of the user's teams places among the teams in the challenge
+	Teams     []teamRank
+	Remaining string
+	NewEmail  string
+}
+
+// SendDailyDigest sends the user what they did yesterday and where their teams stand, if a challenge was running yesterday.
+// today is midnight in the user's timezone. It reports false if there was nothing to send or it was already sent.
+func (s *Server) SendDailyDigest(u DigestUser, today time.Time) (bool, error) {
+	yesterday := today.AddDate(0, 0, -1)
+	challenge, err := s.Store.GetActiveChallenge(yesterday)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	day := yesterday.Format("2006-01-02")
+	done, err := s.Store.IsDigestSent(u.ID, DigestDaily, day)
+	if err != nil || done {
+		return false, err
+	}
+
+	data := dailyDigest{
+		Challenge: challenge.Name,
+		Day:       yesterday.Format("Monday, Jan 2"),
+		Teams:     s.teamRanks(challenge, u.Email),
+		Remaining: challengeRemaining(challenge, today, today.Location()),
+		NewEmail:  NewEmail,
+	}
+	data.Total, data.Breakdown = repsBetween(challenge, s.Store.GetUserReps(challenge, u.Email), yesterday, today)
+
+	err = sendTemplateEmail(u.Email, "Your CountMyReps day: "+data.Day, "digest_daily", data)
+	if err != nil {
+		return false, err
+	}
+	logEvent(nil, "digest", fmt.Sprintf("daily digest for %s to %s", data.Day, u.Email))
+	return markDigestSent(s.Store, u, DigestDaily, day)
+}
+
+// markDigestSent records a digest once it is sent or in the outbox, so one that failed is tried again on the next poll
+func markDigestSent(store Store, u DigestUser, kind string, day string) (bool, error) {
+	_, err := store.MarkDigestSent(u.ID, kind, day)
+	if err != nil {
+		return true, errors.Wrapf(err, "%s digest for %s was sent but not recorded", kind, u.Email)
+	}
+	return true, nil
+}
+
+// weeklyDigest is the data for digest_weekly.html and digest_weekly.txt
+type weeklyDigest struct {
+	Challenge string
+	Week      string
+	Total     int
+	Breakdown []exerciseCount
+	// Leaderboard is the top teams for the challenge so far, followed by any of the user's teams below them
+	Leaderboard []teamTotal
+	Remaining   string
+	NewEmail    string
+}
+
+// SendWeeklyDigest sends the user their reps for the 7 days before today and the team leaderboard, if the week overlapped a challenge.
+// today is midnight in the user's timezone. It reports false if there was nothing to send or it was already sent.
+func (s *Server) SendWeeklyDigest(u DigestUser, today time.Time) (bool, error) {
+	weekStart, lastDay := today.AddDate(0, 0, -7), today.AddDate(0, 0, -1)
+	challenge, err := s.Store.GetCurrentChallenge(lastDay)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if challenge.EndDate.Format("2006-01-02") < weekStart.Format("2006-01-02") {
+		// the challenge was over before the week started
+		return false, nil
+	}
+	day := today.Format("2006-01-02")
+	done, err := s.Store.IsDigestSent(u.ID, DigestWeekly, day)
+	if err != nil || done {
+		return false, err
+	}
+
+	data := weeklyDigest{
+		Challenge: challenge.Name,
+		Week:      weekStart.Format("Jan 2") + " - " + lastDay.Format("Jan 2"),
+		Remaining: challengeRemaining(challenge, today, today.Location()),
+		NewEmail:  NewEmail,
+	}
+	data.Total, data.Breakdown = repsBetween(challenge, s.Store.GetUserReps(challenge, u.Email), weekStart, today)
+
+	mine := make(map[string]bool)
+	for _, team := range s.userTeams(u.Email) {
+		mine[team] = true
+	}
+	for i, total := range rankTeams(s.Store.GetTeamStats(challenge)) {
+		total.Yours = mine[total.Team]
+		if i < digestLeaderboardSize || total.Yours {
+			data.Leaderboard = append(data.Leaderboard, total)
+		}
+	}
+
+	err = sendTemplateEmail(u.Email, "Your CountMyReps week: "+data.Week, "digest_weekly", data)
+	if err != nil {
+		return false, err
+	}
+	logEvent(nil, "digest", fmt.Sprintf("weekly digest for %s to %s", data.Week, u.Email))
+	return markDigestSent(s.Store, u, DigestWeekly, day)
+}
+
+// repsBetween totals the user's reps from start up to end, both midnight in the user's timezone, per exercise in display order
+func repsBetween(c Challenge, userReps []RepData, start time.Time, end time.Time) (int, []exerciseCount) {
+	days := make(map[string]bool)
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		days[dayKey(day, day.Location())] = true
+	}
+	counts := make(map[string]int)
+	for _, rd := range userReps {
+		if !days[rd.Date] {
+			continue
+		}
+		for exercise, count := range rd.ExerciseCounts {
+			counts[exercise] += count
+		}
+	}
+	var total int
+	var breakdown []exerciseCount
+	for _, exercise := range c.ExerciseNames() {
+		total += counts[exercise]
+		breakdown = append(breakdown, exerciseCount{exercise, counts[exercise]})
+	}
+	return total, breakdown
+}
+
+// teamTotal is a line of the team leaderboard
+type teamTotal struct {
+	Rank  int
+	Team  string
+	Total int
+	// Yours is set for the user's own teams
+	Yours bool
+}
+
+// rankTeams orders the teams by total reps, most first; ties share a rank
+func rankTeams(stats map[string]Stats) []teamTotal {
+	var totals []teamTotal
+	for team, st := range stats {
+		totals = append(totals, teamTotal{Team: team, Total: st.TotalReps})
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Total != totals[j].Total {
+			return totals[i].Total > totals[j].Total
+		}
+		return totals[i].Team < totals[j].Team
+	})
+	for i := range totals {
+		totals[i].Rank = i + 1
+		if i > 0 && totals[i].Total == totals[i-1].Total {
+			totals[i].Rank = totals[i-1].Rank
+		}
+	}
+	return totals
+}
+
+// userTeams is the user's office, if they have one, followed by their other teams
+func (s *Server) userTeams(email string) []string {
+	teams := s.Store.GetUserTeams(email)
+	if office := s.Store.GetUserOffice(email); office != "" {
+		teams = append([]string{office}, teams...)
+	}
+	return teams
+}
+
+// teamRanks is where each of the user's teams places among the teams in the challenge
+func (s *Server) teamRanks(c Challenge, email string) []teamRank {
+	board := rankTeams(s.Store.GetTeamStats(c))
+	var ranks []teamRank
+	for _, team := range s.userTeams(email) {
+		for _, total := range board {
+			if total.Team == team {
+				ranks = append(ranks, teamRank{team, total.Rank, len(board)})
+			}
+		}
+	}
+	return ranks
+}
@@ -1,33 +1,95 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
 	"fmt"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
+	stdmail "net/mail"
+	"net/smtp"
+	"net/textproto"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
 // TODO: change to interface so we can unit test
 
-// ErrSubjectFmt ...
-var ErrSubjectFmt = "CountMyReps was unable to parse your subject. Please provide FOUR comma separated numbers like: `5, 10, 15, 20` where the numbers represent pull ups, push ups, squats, and situps respectively. You provided \"%s\""
+// ErrSubjectFmt ... filled in by subjectErrMsg
+var ErrSubjectFmt = "CountMyReps was unable to parse your subject. Please provide %d comma separated numbers like: `%s` where the numbers represent %s respectively, or name the exercises like: `%s`. You provided \"%s\""
+
+// subjectErrMsg is ErrSubjectFmt for the line, with examples for the exercises, ie, the ones in the current challenge
+func subjectErrMsg(exercises []string, line string) string {
+	var numbers, names, named []string
+	for i, exercise := range exercises {
+		numbers = append(numbers, strconv.Itoa(5*(i+1)))
+		names = append(names, strings.ToLower(exercise))
+		if i < 2 {
+			named = append(named, fmt.Sprintf("%d %s", 10*(i+1), addrWord(exercise)))
+		}
+	}
+	if len(names) > 1 {
+		names[len(names)-1] = "and " + names[len(names)-1]
+	}
+	nameList := strings.Join(names, ", ")
+	if len(names) == 2 {
+		nameList = strings.Join(names, " ")
+	}
+	return fmt.Sprintf(ErrSubjectFmt, len(exercises), strings.Join(numbers, ", "), nameList, strings.Join(named, ", "), line)
+}
 
 // ErrToAddrFmt ...
-var ErrToAddrFmt = "CountMyReps only accepts emails to " + NewEmail + ", you sent to \"%s\""
+var ErrToAddrFmt = "CountMyReps only accepts emails to " + NewEmail + " or any dash separated list of exercises @" + EmailDomain + " (valid exercises are %s), you sent to \"%s\""
+
+// ErrExerciseCountFmt ...
+var ErrExerciseCountFmt = "CountMyReps expected %d comma separated numbers because you sent to %s (%s), but your subject had %d: \"%s\""
+
+// ErrNamedRepFmt ...
+var ErrNamedRepFmt = "CountMyReps could not read %s in your subject \"%s\". Name each exercise with its count, like: `pushups 20, squats 30` or `20 pushups`. Valid exercises are: %s"
+
+// ErrChallengeExerciseFmt ...
+var ErrChallengeExerciseFmt = "CountMyReps is not counting %s for %s. The exercises for this challenge are: %s"
+
+// ErrTimezoneFmt ...
+var ErrTimezoneFmt = "CountMyReps did not recognize the timezone \"%s\". Use an IANA timezone name, like: `Timezone: America/Denver`"
+
+// ErrDigestFmt ...
+var ErrDigestFmt = "CountMyReps did not understand the digest \"%s\". Use `Digest: daily`, `Digest: weekly`, `Digest: daily, weekly`, or `Digest: off`"
+
+// ErrBackdateDateFmt ...
+var ErrBackdateDateFmt = "CountMyReps did not understand the day \"%s\". Put a date or yesterday before your reps, like: `2016-11-04: 5, 10, 15, 20` or `yesterday: 5, 10, 15, 20`"
+
+// ErrBackdateRangeFmt ...
+var ErrBackdateRangeFmt = "CountMyReps can only credit reps to the last %d days, and not to the future. You asked for %s"
+
+// ErrBackdateChallengeFmt ...
+var ErrBackdateChallengeFmt = "CountMyReps can't credit reps to %s because no challenge was running that day"
+
+// ErrUndoFmt ...
+var ErrUndoFmt = "CountMyReps found nothing to undo. Undo removes your most recent submission, if it was sent in the last %g hours"
 
 // ErrFromFmt ...
-var ErrFromFmt = "CountMyReps only accepts mail from the sendgrid domain. You used \"%s\""
+var ErrFromFmt = "CountMyReps does not accept mail from \"%s\". Ask whoever runs CountMyReps to add your address or domain to the allowed senders"
 
 // ErrUnexpectedFmt ...
 var ErrUnexpectedFmt = "CountMyReps experienced an unexpected error, please try again later. Error: %s"
 
-// Emailer interface allows us to send emails
+// Emailer interface allows us to send emails. Each email has a plain text and an html version of the same message.
 type Emailer interface {
-	SendEmail(to string, subject string, msg string) error
+	SendEmail(to string, subject string, text string, html string) error
 }
 
 // FakeEmailer is useful for testing
@@ -36,27 +98,89 @@ type FakeEmailer struct {
 }
 
 // SendEmail is a NoOp for the FakeEmailer, returning what ever error we need
-func (f FakeEmailer) SendEmail(to string, subject string, msg string) error {
+func (f FakeEmailer) SendEmail(to string, subject string, text string, html string) error {
 	return f.Err
 }
 
+// SentEmail is an email captured by RecordingEmailer
+type SentEmail struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// RecordingEmailer captures every email instead of sending it, so tests can check the replies. It is safe for concurrent use.
+type RecordingEmailer struct {
+	// Err is returned from every SendEmail, after the email is captured
+	Err error
+
+	mu   sync.Mutex
+	sent []SentEmail
+}
+
+// SendEmail captures the email
+func (e *RecordingEmailer) SendEmail(to string, subject string, text string, html string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sent = append(e.sent, SentEmail{To: to, Subject: subject, Text: text, HTML: html})
+	return e.Err
+}
+
+// Sent lists every captured email, in the order they were sent
+func (e *RecordingEmailer) Sent() []SentEmail {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SentEmail(nil), e.sent...)
+}
+
+// SentTo lists the captured emails to the address, ignoring case and any display name
+func (e *RecordingEmailer) SentTo(addr string) []SentEmail {
+	addr = strings.ToLower(extractEmailAddr(addr))
+	var sent []SentEmail
+	for _, email := range e.Sent() {
+		if strings.ToLower(extractEmailAddr(email.To)) == addr {
+			sent = append(sent, email)
+		}
+	}
+	return sent
+}
+
+// Find returns the first captured email to the address whose subject or plain text contains the text
+func (e *RecordingEmailer) Find(addr string, text string) (SentEmail, bool) {
+	for _, email := range e.SentTo(addr) {
+		if strings.Contains(email.Subject, text) || strings.Contains(email.Text, text) {
+			return email, true
+		}
+	}
+	return SentEmail{}, false
+}
+
+// Reset forgets the captured emails
+func (e *RecordingEmailer) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sent = nil
+}
+
+// EmailFrom is the sender of every email
+var EmailFrom = stdmail.Address{Name: "CountMyReps", Address: "automailer@countmyreps.com"}
+
 // SendGridEmailer matches the Emailer interface allowing us to send email through SendGrid
 type SendGridEmailer struct{}
 
 // SendEmail sends an email through SendGrid
-func (SendGridEmailer) SendEmail(to string, subject string, msg string) error {
-	from := mail.NewEmail("CountMyReps", "automailer@countmyreps.com")
-	// at this point, all recipients _should_ be firstname.lastname@sendgrid.com or firstname@sendgrid.com
+func (SendGridEmailer) SendEmail(to string, subject string, text string, html string) error {
+	from := mail.NewEmail(EmailFrom.Name, EmailFrom.Address)
+	// recipients are usually firstname.lastname@ or firstname@ an allowed domain
 	toName := strings.Split(to, ".")[0]
 	if strings.Contains(toName, "@") {
 		toName = strings.Split(toName, "@")[0]
 	}
 	toAddr := mail.NewEmail(toName, to)
 
-	msg = `<img src="http://countmyreps.com/images/mustache-thin.jpg" style="margin:auto; width:300px; display:block"/>` + msg
-
-	content := mail.NewContent("text/html", msg)
-	m := mail.NewV3MailInit(from, subject, toAddr, content)
+	// SendGrid wants the plain text first
+	m := mail.NewV3MailInit(from, subject, toAddr, mail.NewContent("text/plain", text), mail.NewContent("text/html", html))
 
 	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
 	request.Method = "POST"
@@ -71,84 +195,309 @@ func (SendGridEmailer) SendEmail(to string, subject string, msg string) error {
 	return nil
 }
 
+// SMTPEmailer matches the Emailer interface, sending through any SMTP relay
+type SMTPEmailer struct {
+	Host string
+	Port int
+	// Username and Password are for PLAIN auth; leave Username empty for a relay without auth
+	Username string
+	Password string
+	// StartTLS requires the relay to support STARTTLS and upgrades to it before auth
+	StartTLS bool
+}
+
+// SendEmail delivers the message to the relay
+func (e SMTPEmailer) SendEmail(to string, subject string, text string, html string) error {
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return errors.Wrapf(err, "unable to connect to smtp relay %s", addr)
+	}
+	defer c.Close()
+
+	if e.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp relay %s does not support STARTTLS", addr)
+		}
+		err = c.StartTLS(&tls.Config{ServerName: e.Host})
+		if err != nil {
+			return errors.Wrapf(err, "unable to start tls with smtp relay %s", addr)
+		}
+	}
+	if e.Username != "" {
+		// PlainAuth refuses to send the password without tls, unless the relay is on localhost
+		err = c.Auth(smtp.PlainAuth("", e.Username, e.Password, e.Host))
+		if err != nil {
+			return errors.Wrapf(err, "unable to authenticate with smtp relay %s", addr)
+		}
+	}
+
+	err = c.Mail(EmailFrom.Address)
+	if err != nil {
+		return errors.Wrapf(err, "smtp relay %s refused the sender", addr)
+	}
+	err = c.Rcpt(extractEmailAddr(to))
+	if err != nil {
+		return errors.Wrapf(err, "smtp relay %s refused %s", addr, to)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errors.Wrapf(err, "smtp relay %s refused data", addr)
+	}
+	_, err = w.Write(formatEmail(to, subject, text, html))
+	if err != nil {
+		return errors.Wrap(err, "unable to write message to smtp relay")
+	}
+	err = w.Close()
+	if err != nil {
+		return errors.Wrapf(err, "smtp relay %s did not accept the message", addr)
+	}
+	return c.Quit()
+}
+
+// formatEmail formats a complete email from EmailFrom, with the text and html as alternative parts
+func formatEmail(to string, subject string, text string, html string) []byte {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range [][2]string{{"text/plain", text}, {"text/html", html}} {
+		w, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part[0] + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		qp := quotedprintable.NewWriter(w)
+		qp.Write([]byte(part[1]))
+		qp.Close()
+	}
+	mw.Close()
+
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", EmailFrom.String()},
+		{"To", (&stdmail.Address{Address: extractEmailAddr(to)}).String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), rand.Int63(), EmailDomain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()})},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+// sendTemplateEmail renders go_templates/email/<name>.txt and <name>.html with data and sends them as one email
+func sendTemplateEmail(to string, subject string, name string, data interface{}) error {
+	var text, html bytes.Buffer
+	err := EmailTextTemplates.ExecuteTemplate(&text, name+".txt", data)
+	if err != nil {
+		return errors.Wrapf(err, "unable to render %s.txt", name)
+	}
+	err = EmailHTMLTemplates.ExecuteTemplate(&html, name+".html", data)
+	if err != nil {
+		return errors.Wrapf(err, "unable to render %s.html", name)
+	}
+	return EmailSender.SendEmail(to, subject, text.String(), html.String())
+}
+
+// errorEmail is the data for error.html and error.txt
+type errorEmail struct {
+	NewEmail    string
+	EmailDomain string
+	Exercises   string
+	Offices     string
+	// To, Subject, and Time are from the message that failed
+	To      string
+	Subject string
+	Time    string
+	// Errors has one entry per failed command
+	Errors []string
+}
+
 // SendErrorEmail sets up the error message and then calls sendEmail
-func (s *Server) SendErrorEmail(rcpt string, originalAddressTo string, subject string, msg string) error {
-	officeList := strings.Join(Offices, ", ")
-	msgFmt := `
-	<h3>Uh oh!</h3>
-	<p>
-	There was an error with your CountMyReps Submission.<br /><br />
-    Make sure that you addressed your email to %s<br />
-    Make sure that your subject line was FOUR comma separated numbers, like: 5, 10, 15, 20<br />
-    If you were trying to set your office location, make sure you choose one from:<br />
-	%s<br />
-	(This should be sent in its own email). The same for if you are removing or adding a team. Use 'Team Add: team-name' or 'Team Remove: team-name'.
-    </p>
-	<p>
-    Details from received message:<br />
-    Addessed to: %s<br />
-    Subject: %s<br />
-    Time: %s<br />
-	Error: %s<br />
-	</p>`
-	return EmailSender.SendEmail(rcpt, "Error with your submission", fmt.Sprintf(msgFmt, NewEmail, officeList, originalAddressTo, subject, time.Now().String(), msg))
-}
-
-// SendSuccessEmail sets up the success message and calls sendEmail
-func (s *Server) SendSuccessEmail(to string) error {
-	office := getUserOffice(s.DB, to)
-	officeStats := getOfficeStats(s.DB)
-	var officeMsg string
-	var forTheTeam string
-	if office == "" || office == "Unknown" {
-		officeMsg = fmt.Sprintf("You've not linked your reps to an office. Send an email to %s with your office in the subject line. Valid office choices are: <br />%s", NewEmail, strings.Join(Offices, ", "))
-		forTheTeam = ""
-	} else {
-		officeMsg = officeComparisonUpdate(office, officeStats)
-		forTheTeam = fmt.Sprintf(" for the %s team", office)
+func (s *Server) SendErrorEmail(rcpt string, originalAddressTo string, subject string, msgs ...string) error {
+	return sendTemplateEmail(rcpt, "Error with your submission", "error", errorEmail{
+		NewEmail:    NewEmail,
+		EmailDomain: EmailDomain,
+		Exercises:   strings.Join(exerciseWords(), ", "),
+		Offices:     strings.Join(Offices, ", "),
+		To:          originalAddressTo,
+		Subject:     subject,
+		Time:        time.Now().String(),
+		Errors:      msgs,
+	})
+}
+
+// successEmail is the data for success.html and success.txt
+type successEmail struct {
+	// Notices say what each command did
+	Notices []string
+	Total   int
+	Avg     int
+	// Office is empty if the user has not set one; then the email lists Offices to pick from
+	Office           string
+	OfficeComparison string
+	Offices          string
+	NewEmail         string
+	Teams            []string
+	OfficeTotals     string
+}
+
+// SendSuccessEmail sets up the success message and calls sendEmail. Notices, ie, what each command did, are shown first.
+func (s *Server) SendSuccessEmail(to string, notices ...string) error {
+	challenge, err := s.Store.GetCurrentChallenge(time.Now())
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	office := s.Store.GetUserOffice(to)
+	officeStats := s.Store.GetOfficeStats(challenge)
+	data := successEmail{
+		Notices:  notices,
+		Offices:  strings.Join(Offices, ", "),
+		NewEmail: NewEmail,
+		Teams:    s.Store.GetUserTeams(to),
 	}
-	total := totalReps(getUserReps(s.DB, to))
-	days := int(time.Since(StartDate).Hours() / float64(24))
+	if office != "" && office != "Unknown" {
+		data.Office = office
+		data.OfficeComparison = officeComparisonUpdate(office, officeStats)
+	}
+	data.Total = totalReps(s.Store.GetUserReps(challenge, to))
+	days := challenge.daysElapsed(time.Now(), s.Store.GetUserLocation(to))
 	if days == 0 {
 		days = 1 // avoid divide by zero
 	}
-	avg := total / days
+	data.Avg = data.Total / days
 
-	var data []string
+	var totals []string
 	for officeName, stats := range officeStats {
-		data = append(data, fmt.Sprintf("%s: %d", officeName, stats.TotalReps))
+		totals = append(totals, fmt.Sprintf("%s: %d", officeName, stats.TotalReps))
 	}
+	sort.Strings(totals)
+	data.OfficeTotals = strings.Join(totals, ", ")
 
-	var teamsMsg string
-	teams := getUserTeams(s.DB, to)
-	if len(teams) == 0 {
-		teamsMsg = "You are not with any teams yet! Send an email with the subject 'Team Add: team-name' to get on a team. You can be on multiple teams!"
-	} else {
-		teamsMsg = "You are on the following teams. You can send an email with the subject 'Team Remove: team-name' to get off them, or `Team Add: team-name' to join others."
-		var teamList string
-		for _, team := range teams {
-			teamList += fmt.Sprintf("<li>%s</li>", team)
+	return sendTemplateEmail(to, "Success!", "success", data)
+}
+
+// SendReportEmail sends the named report, ie, ReportStats
+func (s *Server) SendReportEmail(to string, report string) error {
+	switch report {
+	case ReportStats:
+		return s.SendStatsEmail(to)
+	case ReportHelp:
+		return s.SendHelpEmail(to)
+	}
+	return fmt.Errorf("unknown report %q", report)
+}
+
+// statsEmail is the data for stats.html and stats.txt. Challenge is empty when none is running.
+type statsEmail struct {
+	Challenge string
+	Total     int
+	Breakdown []exerciseCount
+	Ranks     []teamRank
+	Remaining string
+}
+
+// exerciseCount is one line of the stats breakdown
+type exerciseCount struct {
+	Exercise string
+	Count    int
+}
+
+// teamRank is where the user places on a team: Rank of Of members
+type teamRank struct {
+	Team string
+	Rank int
+	Of   int
+}
+
+// SendStatsEmail replies with the user's totals, per exercise breakdown, rank on each team, and days remaining in the current challenge
+func (s *Server) SendStatsEmail(to string) error {
+	challenge, err := s.Store.GetCurrentChallenge(time.Now())
+	if err == sql.ErrNoRows {
+		return sendTemplateEmail(to, "Your CountMyReps stats", "stats", statsEmail{})
+	} else if err != nil {
+		return err
+	}
+
+	// totals per exercise, in display order
+	userReps := s.Store.GetUserReps(challenge, to)
+	counts := make(map[string]int)
+	for _, rd := range userReps {
+		for exercise, count := range rd.ExerciseCounts {
+			counts[exercise] += count
+		}
+	}
+	data := statsEmail{Challenge: challenge.Name, Total: totalReps(userReps)}
+	for _, exercise := range challenge.ExerciseNames() {
+		data.Breakdown = append(data.Breakdown, exerciseCount{exercise, counts[exercise]})
+	}
+
+	// rank on the office and each team; ties share a rank
+	for _, team := range s.userTeams(to) {
+		totals, err := s.Store.GetTeamMemberTotals(challenge, team)
+		if err != nil {
+			logError(nil, err, "unable to get team member totals for stats")
+			continue
+		}
+		mine := data.Total
+		if t, ok := totals[to]; ok {
+			mine = t
 		}
-		teamsMsg = fmt.Sprintf("%s<ul>%s</ul>", teamsMsg, teamList)
-	}
-
-	officeTotals := "The office totals are: " + strings.Join(data, ", ")
-
-	msg := fmt.Sprintf(`<h3>Keep it up!</h3>
-	<p>
-	You've logged a total of %d%s, an average of %d per day.
-	</p>
-	<p>
-	%s
-	</p>
-	<p>
-	%s
-	</p>
-	<p>
-	%s
-	</p>`, total, forTheTeam, avg, officeMsg, teamsMsg, officeTotals)
-
-	return EmailSender.SendEmail(to, "Success!", msg)
+		rank := 1
+		for _, memberTotal := range totals {
+			if memberTotal > mine {
+				rank++
+			}
+		}
+		data.Ranks = append(data.Ranks, teamRank{team, rank, len(totals)})
+	}
+
+	data.Remaining = challengeRemaining(challenge, time.Now(), s.Store.GetUserLocation(to))
+
+	return sendTemplateEmail(to, "Your CountMyReps stats", "stats", data)
+}
+
+// challengeRemaining says how many days are left in the challenge as of now, in the given timezone
+func challengeRemaining(c Challenge, now time.Time, loc *time.Location) string {
+	switch days := c.daysRemaining(now, loc); days {
+	case 0:
+		return fmt.Sprintf("%s is over. Thanks for playing!", c.Name)
+	case 1:
+		return fmt.Sprintf("Today is the last day of %s.", c.Name)
+	default:
+		return fmt.Sprintf("There are %d days left in %s, counting today.", days, c.Name)
+	}
+}
+
+// helpEmail is the data for help.html and help.txt
+type helpEmail struct {
+	EmailDomain  string
+	NewEmail     string
+	BackdateDays int
+	UndoHours    float64
+	Exercises    string
+	Offices      string
+	Teams        string
+}
+
+// SendHelpEmail replies with every command and the current offices and teams
+func (s *Server) SendHelpEmail(to string) error {
+	teams, err := s.Store.GetTeamNames()
+	if err != nil {
+		return err
+	}
+	return sendTemplateEmail(to, "CountMyReps help", "help", helpEmail{
+		EmailDomain:  EmailDomain,
+		NewEmail:     NewEmail,
+		BackdateDays: BackdateDays,
+		UndoHours:    UndoWindow.Hours(),
+		Exercises:    strings.Join(exerciseWords(), ", "),
+		Offices:      strings.Join(Offices, ", "),
+		Teams:        strings.Join(teams, ", "),
+	})
 }
 
 // extractEmailAddr gets the email address from the email string
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,7 +10,11 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/smtp"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,12 +22,26 @@ import (
 	"github.com/sethgrid/countmyreps/integration"
 )
 
+// testMySQLDSN runs the endpoint tests against a scratch MySQL database instead of SQLite when set, ie,
+// COUNTMYREPS_TEST_MYSQL_DSN="root@tcp(127.0.0.1:3306)/?parseTime=true" go test
+var testMySQLDSN = os.Getenv("COUNTMYREPS_TEST_MYSQL_DSN")
+
 func setup() *Server {
-	tmpDB := fmt.Sprintf("countmyreps_test_%d_%d", time.Now().Unix(), rand.Intn(100))
-	db := integration.SetupDB("root@tcp(127.0.0.1:3306)/?parseTime=true", tmpDB, true)
-	integration.Seed(db, "2016-11-01", "2016-11-30", "2016-11-15")
+	var store Store
+	var tmpDB string
+	if testMySQLDSN != "" {
+		tmpDB = fmt.Sprintf("countmyreps_test_%d_%d", time.Now().UnixNano(), rand.Intn(100))
+		db := integration.SetupDB(testMySQLDSN, tmpDB, true)
+		integration.Seed(db, "2016-11-01", "2016-11-30", "2016-11-15")
+		store = NewMySQLStore(db)
+	} else {
+		tmpDB = filepath.Join(os.TempDir(), fmt.Sprintf("countmyreps_test_%d_%d.db", time.Now().UnixNano(), rand.Intn(100)))
+		db := integration.SetupSQLiteDB(tmpDB)
+		integration.Seed(db, "2016-11-01", "2016-11-30", "2016-11-15")
+		store = NewSQLiteStore(db)
+	}
 
-	s := NewServer(db, 0, FakeEmailer{})
+	s := NewServer(store, 0, &RecordingEmailer{})
 	s.dbname = tmpDB
 	go func() {
 		err := s.Serve()
@@ -35,7 +54,11 @@ func setup() *Server {
 		time.Sleep(1 * time.Millisecond)
 	}
 
-	err := populateOfficesVar(db)
+	err := populateOfficesVar(s.Store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = populateExercisesVar(s.Store)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -45,8 +68,34 @@ func setup() *Server {
 
 func teardown(s *Server) {
 	s.Close()
-	integration.TearDownDB(s.DB, s.dbname)
-	s.DB.Close()
+	if testMySQLDSN != "" {
+		db := testDB(s)
+		integration.TearDownDB(db, s.dbname)
+		db.Close()
+		return
+	}
+	integration.TearDownSQLiteDB(testDB(s), s.dbname)
+}
+
+// testDB is the database behind the server's store, for checking rows directly
+func testDB(s *Server) *sql.DB {
+	switch store := s.Store.(type) {
+	case *SQLiteStore:
+		return store.DB
+	case *MySQLStore:
+		return store.DB
+	}
+	log.Fatalf("no database for store %T", s.Store)
+	return nil
+}
+
+// sentEmails is the RecordingEmailer setup gave the server, to check the replies
+func sentEmails(t *testing.T) *RecordingEmailer {
+	rec, ok := EmailSender.(*RecordingEmailer)
+	if !ok {
+		t.Fatalf("got emailer %T, want *RecordingEmailer", EmailSender)
+	}
+	return rec
 }
 
 type distilledResponse struct {
@@ -55,8 +104,19 @@ type distilledResponse struct {
 }
 
 func getResponse(port int, path string) (*distilledResponse, error) {
+	return getResponseWithHeader(port, path, nil)
+}
+
+func getResponseWithHeader(port int, path string, header http.Header) (*distilledResponse, error) {
 	fullURL := fmt.Sprintf("http://127.0.0.1:%d%s", port, path)
-	resp, err := http.Get(fullURL)
+	req, err := http.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create request for %s", fullURL)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to GET %s", fullURL)
 	}
@@ -99,8 +159,69 @@ func TestJsonEndpoint(t *testing.T) {
 	}
 }
 
+func TestJsonChallenge(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	// defaults to the most recent challenge, which has all the seeded reps
+	resp, err := getResponse(srv.Port, "/json?email=oc_1@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vd := ViewData{}
+	err = json.Unmarshal(resp.body, &vd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := vd.Challenge, "Movember 2016"; got != want {
+		t.Errorf("got %s, want %s for default challenge", got, want)
+	}
+	if got, want := len(vd.Challenges), 2; got != want {
+		t.Errorf("got %d, want %d challenges", got, want)
+	}
+	if totalReps(vd.UserReps) == 0 {
+		t.Errorf("got no reps, want seeded reps for %s", vd.Challenge)
+	}
+
+	// last year's challenge can be viewed at the same time and has no reps
+	resp, err = getResponse(srv.Port, "/json?email=oc_1@sendgrid.com&challenge=Movember+2015")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vd = ViewData{}
+	err = json.Unmarshal(resp.body, &vd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := vd.Challenge, "Movember 2015"; got != want {
+		t.Errorf("got %s, want %s for challenge", got, want)
+	}
+	if got, want := totalReps(vd.UserReps), 0; got != want {
+		t.Errorf("got %d, want %d reps for %s", got, want, vd.Challenge)
+	}
+	if got, want := len(vd.UserReps), 30; got != want {
+		t.Errorf("got %d, want %d days for %s", got, want, vd.Challenge)
+	}
+
+	resp, err = getResponse(srv.Port, "/json?email=oc_1@sendgrid.com&challenge=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.code, http.StatusNotFound; got != want {
+		t.Errorf("got %d, want %d for unknown challenge", got, want)
+	}
+}
+
 func parseAPIRecv(port int, subject string, from string) error {
-	resp, err := http.PostForm(fmt.Sprintf("http://127.0.0.1:%d/parseapi/index.php", port), url.Values{"subject": {subject}, "from": {from}, "to": {"pullups-pushups-squats-situps@countmyreps.com"}})
+	return parseAPIRecvTo(port, subject, from, "pullups-pushups-squats-situps@countmyreps.com")
+}
+
+func parseAPIRecvTo(port int, subject string, from string, to string) error {
+	return parseAPIPost(port, url.Values{"subject": {subject}, "from": {from}, "to": {to}})
+}
+
+func parseAPIPost(port int, form url.Values) error {
+	resp, err := http.PostForm(fmt.Sprintf("http://127.0.0.1:%d/parseapi/index.php", port), form)
 	if err != nil {
 		return err
 	}
@@ -138,6 +259,9 @@ func TestAddRemoveTeam(t *testing.T) {
 	if !contains("my_team", vd.UserTeams) {
 		t.Errorf("got %v, want %s in list", vd.UserTeams, "my_team")
 	}
+	if email, ok := sentEmails(t).Find("oc_3@sendgrid.com", "You are on the my_team team."); !ok || email.Subject != "Success!" {
+		t.Errorf("got %+v, want a success email saying oc_3 joined my_team", sentEmails(t).Sent())
+	}
 
 	err = parseAPIRecv(srv.Port, "Team Remove: my_team", "oc_3@sendgrid.com")
 	if err != nil {
@@ -164,6 +288,110 @@ func TestAddRemoveTeam(t *testing.T) {
 	if contains("my_team", vd.UserTeams) {
 		t.Errorf("got %v, don't want %s in list", vd.UserTeams, "my_team")
 	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", "You are off the my_team team."); !ok {
+		t.Errorf("got %+v, want an email saying oc_3 left my_team", sentEmails(t).Sent())
+	}
+}
+
+func TestRecipientExercises(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	err := parseAPIRecvTo(srv.Port, "5, 10", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email, ok := sentEmails(t).Find("oc_3@sendgrid.com", "Logged 5 Sit Ups, 10 Pull Ups."); !ok || email.Subject != "Success!" {
+		t.Errorf("got %+v, want a success email for the reps", sentEmails(t).Sent())
+	}
+	// wrong number of reps for the address should not be logged
+	err = parseAPIRecvTo(srv.Port, "5, 10, 15", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email, ok := sentEmails(t).Find("oc_3@sendgrid.com", "expected 2 comma separated numbers"); !ok || email.Subject != "Error with your submission" {
+		t.Errorf("got %+v, want an error email for the wrong number of reps", sentEmails(t).Sent())
+	}
+	// the hint for a subject that is not reps is for the exercises in the address
+	err = parseAPIRecvTo(srv.Port, "lots of reps", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", "provide 2 comma separated numbers like: `5, 10` where the numbers represent sit ups and pull ups"); !ok {
+		t.Errorf("got %+v, want a hint for sit ups and pull ups", sentEmails(t).Sent())
+	}
+
+	resp, err := getResponse(srv.Port, "/json?email=oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Resp Body:\n%s", resp.body)
+
+	vd := ViewData{}
+	err = json.Unmarshal(resp.body, &vd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	counts := make(map[string]int)
+	for _, rd := range vd.TodaysReps {
+		for exercise, count := range rd.ExerciseCounts {
+			counts[exercise] += count
+		}
+	}
+	if got, want := len(counts), 2; got != want {
+		t.Errorf("got %d, want %d exercises logged today: %v", got, want, counts)
+	}
+	if got, want := counts["Sit Ups"], 5; got != want {
+		t.Errorf("got %d, want %d sit ups", got, want)
+	}
+	if got, want := counts["Pull Ups"], 10; got != want {
+		t.Errorf("got %d, want %d pull ups", got, want)
+	}
+}
+
+func TestSetOffice(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	getOffice := func() string {
+		resp, err := getResponse(srv.Port, "/json?email=oc_3@sendgrid.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		vd := ViewData{}
+		err = json.Unmarshal(resp.body, &vd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contains("OC", vd.UserTeams) || contains("Denver", vd.UserTeams) {
+			t.Errorf("got %v, don't want offices listed with teams", vd.UserTeams)
+		}
+		return vd.UserOffice
+	}
+
+	// oc_3@sendgrid.com is a known user from integration.Seed()
+	if got, want := getOffice(), "OC"; got != want {
+		t.Errorf("got %q, want %q for seeded office", got, want)
+	}
+
+	// the office name subject still works, and moves the user off their old office
+	err := parseAPIRecv(srv.Port, "denver", "oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getOffice(), "Denver"; got != want {
+		t.Errorf("got %q, want %q after office subject", got, want)
+	}
+
+	// adding an office as a team is the same as setting the office
+	err = parseAPIRecv(srv.Port, "Team Add: OC", "oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getOffice(), "OC"; got != want {
+		t.Errorf("got %q, want %q after team add", got, want)
+	}
 }
 
 func contains(needle string, haystack []string) bool {
@@ -241,3 +469,909 @@ func TestIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestUndo(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+
+	countReps := func() int {
+		var count int
+		err := db.QueryRow("SELECT count(*) FROM reps JOIN user ON reps.user_id=user.id WHERE user.email='oc_3@sendgrid.com'").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	seeded := countReps()
+
+	err := parseAPIRecvTo(srv.Port, "60, 2", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countReps(), seeded+2; got != want {
+		t.Fatalf("got %d, want %d reps after submitting", got, want)
+	}
+
+	resp, err := getResponse(srv.Port, "/json?email=oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vd := ViewData{}
+	err = json.Unmarshal(resp.body, &vd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(vd.LastSubmission, ": 60 Sit Ups, 2 Pull Ups") {
+		t.Errorf("got last submission %q, want the sit ups and pull ups just sent", vd.LastSubmission)
+	}
+
+	err = parseAPIRecvTo(srv.Port, "Undo", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countReps(), seeded; got != want {
+		t.Errorf("got %d, want %d reps after undo", got, want)
+	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", "60 Sit Ups, 2 Pull Ups."); !ok {
+		t.Errorf("got %+v, want an email saying which submission was removed", sentEmails(t).SentTo("oc_3@sendgrid.com"))
+	}
+
+	// the seeded reps are from 2016, well outside the undo window
+	err = parseAPIRecvTo(srv.Port, "undo", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countReps(), seeded; got != want {
+		t.Errorf("got %d, want %d reps after undo with nothing recent", got, want)
+	}
+	if email, ok := sentEmails(t).Find("oc_3@sendgrid.com", "found nothing to undo"); !ok || email.Subject != "Error with your submission" {
+		t.Errorf("got %+v, want an error email for nothing to undo", sentEmails(t).SentTo("oc_3@sendgrid.com"))
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+
+	form := url.Values{
+		"subject": {"5, 10"},
+		"from":    {"oc_3@sendgrid.com"},
+		"to":      {"situps-pullups@countmyreps.com"},
+		"headers": {"Message-ID: <retry-me@mail.example.com>\nSubject: 5, 10\n"},
+	}
+	// SendGrid retries the same message when we are slow to respond
+	for i := 0; i < 3; i++ {
+		err := parseAPIPost(srv.Port, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var submissions int
+	err := db.QueryRow("SELECT count(*) FROM submission WHERE message_id='<retry-me@mail.example.com>'").Scan(&submissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := submissions, 1; got != want {
+		t.Errorf("got %d, want %d submissions for a redelivered message", got, want)
+	}
+	if got, want := len(sentEmails(t).SentTo("oc_3@sendgrid.com")), 1; got != want {
+		t.Errorf("got %d, want %d replies to a redelivered message", got, want)
+	}
+
+	// a different message with the same subject is counted
+	form.Set("headers", "Message-ID: <second@mail.example.com>\n")
+	err = parseAPIPost(srv.Port, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow("SELECT count(*) FROM submission WHERE subject='5, 10'").Scan(&submissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := submissions, 2; got != want {
+		t.Errorf("got %d, want %d submissions for two messages", got, want)
+	}
+}
+
+func TestRedeliveryAfterError(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+
+	form := url.Values{
+		"subject": {"Team Add: retried"},
+		"from":    {"oc_3@sendgrid.com"},
+		"to":      {"situps-pullups@countmyreps.com"},
+		"headers": {"Message-ID: <db-down@mail.example.com>\n"},
+	}
+	// the team can't be added while its table is missing
+	if _, err := db.Exec("ALTER TABLE user_team RENAME TO user_team_away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseAPIPost(srv.Port, form); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("ALTER TABLE user_team_away RENAME TO user_team"); err != nil {
+		t.Fatal(err)
+	}
+	if processed, err := srv.Store.IsMessageProcessed("<db-down@mail.example.com>"); err != nil || processed {
+		t.Errorf("got processed %t (%v), want the message left for a redelivery", processed, err)
+	}
+
+	// so the redelivery is run
+	if err := parseAPIPost(srv.Port, form); err != nil {
+		t.Fatal(err)
+	}
+	if !contains("retried", srv.Store.GetUserTeams("oc_3@sendgrid.com")) {
+		t.Errorf("got teams %v, want the redelivery to add retried", srv.Store.GetUserTeams("oc_3@sendgrid.com"))
+	}
+	if processed, err := srv.Store.IsMessageProcessed("<db-down@mail.example.com>"); err != nil || !processed {
+		t.Errorf("got processed %t (%v), want it recorded after it ran", processed, err)
+	}
+
+	// old Message-IDs are forgotten
+	if err := NewJanitor(srv.Store).Prune(time.Now().Add(ProcessedMessageTTL + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if processed, err := srv.Store.IsMessageProcessed("<db-down@mail.example.com>"); err != nil || processed {
+		t.Errorf("got processed %t (%v), want it pruned", processed, err)
+	}
+}
+
+func TestBackdatedSubmission(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+
+	// the seeded challenges are long over, so run one around today
+	now := time.Now().In(srv.Store.GetUserLocation("oc_3@sendgrid.com"))
+	_, err := db.Exec("INSERT INTO challenge (name, start_date, end_date) VALUES ('This Week', ?, ?)", now.AddDate(0, 0, -3).Format("2006-01-02"), now.AddDate(0, 0, 3).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = parseAPIRecvTo(srv.Port, "yesterday: 5, 10", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// too far back for the window
+	err = parseAPIRecvTo(srv.Port, now.AddDate(0, 0, -BackdateDays-1).Format("2006-01-02")+": 7, 7", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := srv.Store.GetChallenge("This Week")
+	if err != nil {
+		t.Fatal(err)
+	}
+	yesterday := dayKey(now.AddDate(0, 0, -1), now.Location())
+	var found bool
+	for _, rd := range srv.Store.GetUserReps(c, "oc_3@sendgrid.com") {
+		want := 0
+		if rd.Date == yesterday {
+			found = true
+			want = 5
+		}
+		if got := rd.ExerciseCounts["Sit Ups"]; got != want {
+			t.Errorf("got %d, want %d sit ups on %s", got, want, rd.Date)
+		}
+	}
+	if !found {
+		t.Errorf("no day %s in the challenge", yesterday)
+	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", "credited to "+now.AddDate(0, 0, -1).Format("Monday, Jan 2")); !ok {
+		t.Errorf("got %+v, want a success email saying the reps were credited to yesterday", sentEmails(t).Sent())
+	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", fmt.Sprintf("the last %d days", BackdateDays)); !ok {
+		t.Errorf("got %+v, want an error email for a day outside the window", sentEmails(t).Sent())
+	}
+}
+
+func TestNamedReps(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	err := parseAPIRecv(srv.Port, "pushups 20, 5 situps", "oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a typo logs nothing
+	err = parseAPIRecv(srv.Port, "pushups 20, burpes 10", "oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := getResponse(srv.Port, "/json?email=oc_3@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vd := ViewData{}
+	err = json.Unmarshal(resp.body, &vd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, rd := range vd.TodaysReps {
+		for exercise, count := range rd.ExerciseCounts {
+			counts[exercise] += count
+		}
+	}
+	if got, want := fmt.Sprint(counts), fmt.Sprint(map[string]int{"Push Ups": 20, "Sit Ups": 5}); got != want {
+		t.Errorf("got %s, want %s logged today", got, want)
+	}
+
+	var subjects []string
+	for _, email := range sentEmails(t).SentTo("oc_3@sendgrid.com") {
+		subjects = append(subjects, email.Subject)
+	}
+	if got, want := strings.Join(subjects, ", "), "Success!, Error with your submission"; got != want {
+		t.Errorf("got replies %q, want %q", got, want)
+	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", "could not read"); !ok {
+		t.Error("the error email does not say what could not be read")
+	}
+}
+
+func TestBodyCommands(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	err := parseAPIPost(srv.Port, url.Values{
+		"subject": {"Re: this morning"},
+		"from":    {"oc_3@sendgrid.com"},
+		"to":      {"situps-pullups@countmyreps.com"},
+		"text":    {"Hi!\nTeam Add: early_birds\n5, 10\n\n-- \nOC 3\n\n> 100, 100\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !contains("early_birds", srv.Store.GetUserTeams("oc_3@sendgrid.com")) {
+		t.Error("team add in the body was not run")
+	}
+	counts := make(map[string]int)
+	for _, rd := range srv.Store.GetTodaysReps("oc_3@sendgrid.com") {
+		for exercise, count := range rd.ExerciseCounts {
+			counts[exercise] += count
+		}
+	}
+	// the quoted reply is not counted
+	if got, want := fmt.Sprint(counts), fmt.Sprint(map[string]int{"Sit Ups": 5, "Pull Ups": 10}); got != want {
+		t.Errorf("got %s, want %s logged today", got, want)
+	}
+}
+
+func TestBodyProseIsNotACommand(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	// numbers in prose and signatures are not rep counts
+	err := parseAPIPost(srv.Port, url.Values{
+		"subject": {"Re: this morning"},
+		"from":    {"oc_3@sendgrid.com"},
+		"to":      {"situps-pullups@countmyreps.com"},
+		"text":    {"5, 10\nDid these at 6am with 3 friends\n\nThanks,\nOC 3\nEngineer, Floor 4\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := sentEmails(t).SentTo("oc_3@sendgrid.com")
+	if len(sent) != 1 || sent[0].Subject != "Success!" {
+		t.Fatalf("got %v, want a single success email", sent)
+	}
+	if !strings.Contains(sent[0].Text, "Logged 5 Sit Ups, 10 Pull Ups.") || strings.Contains(sent[0].Text, "could not read") {
+		t.Errorf("got failures for prose or the signature:\n%s", sent[0].Text)
+	}
+}
+
+func TestReportsAreReadOnly(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+
+	counts := func() string {
+		var users, reps, userTeams int
+		err := db.QueryRow("SELECT (SELECT count(*) FROM user), (SELECT count(*) FROM reps), (SELECT count(*) FROM user_team)").Scan(&users, &reps, &userTeams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d users, %d reps, %d team memberships", users, reps, userTeams)
+	}
+	before := counts()
+
+	// help works from someone we have never heard from, sent to any address
+	err := parseAPIRecvTo(srv.Port, "help", "new_person@sendgrid.com", "help@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parseAPIRecv(srv.Port, "Stats", "oc_1@sendgrid.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parseAPIPost(srv.Port, url.Values{"subject": {"stats"}, "from": {"oc_2@sendgrid.com"}, "to": {NewEmail}, "text": {"help"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := counts(), before; got != want {
+		t.Errorf("got %s, want %s after reports", got, want)
+	}
+
+	// each report is its own email, with no success email alongside
+	for addr, want := range map[string]string{
+		"new_person@sendgrid.com": "CountMyReps help",
+		"oc_1@sendgrid.com":       "Your CountMyReps stats",
+		"oc_2@sendgrid.com":       "Your CountMyReps stats, CountMyReps help",
+	} {
+		var subjects []string
+		for _, email := range sentEmails(t).SentTo(addr) {
+			subjects = append(subjects, email.Subject)
+		}
+		if got := strings.Join(subjects, ", "); got != want {
+			t.Errorf("got replies %q, want %q to %s", got, want, addr)
+		}
+	}
+}
+
+func TestRejectedSenders(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+	defer func(policy string) { RejectedSenderPolicy = policy }(RejectedSenderPolicy)
+
+	countUsers := func(email string) int {
+		var count int
+		err := db.QueryRow("SELECT count(*) FROM user WHERE email=?", email).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	for _, policy := range []string{SenderDrop, SenderBounce} {
+		RejectedSenderPolicy = policy
+		sentEmails(t).Reset()
+		err := parseAPIRecvTo(srv.Port, "5, 10", "outsider@example.com", "situps-pullups@countmyreps.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := countUsers("outsider@example.com"), 0; got != want {
+			t.Errorf("%s: got %d users, want %d for a rejected sender", policy, got, want)
+		}
+		// only a bounce replies, and with why the mail was refused
+		_, bounced := sentEmails(t).Find("outsider@example.com", fmt.Sprintf(ErrFromFmt, "outsider@example.com"))
+		if got, want := len(sentEmails(t).Sent()) == 1 && bounced, policy == SenderBounce; got != want {
+			t.Errorf("%s: got %+v, want bounced %t", policy, sentEmails(t).Sent(), want)
+		}
+	}
+	sentEmails(t).Reset()
+
+	RejectedSenderPolicy = SenderQueue
+	err := parseAPIRecvTo(srv.Port, "5, 10", "Outsider <outsider@example.com>", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := srv.Store.GetQueuedMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 {
+		t.Fatalf("got %d queued messages, want 1", len(queued))
+	}
+	if got, want := queued[0].From, "outsider@example.com"; got != want {
+		t.Errorf("got %q, want queued message from %q", got, want)
+	}
+	if got, want := countUsers("outsider@example.com"), 0; got != want {
+		t.Errorf("got %d users, want %d before approval", got, want)
+	}
+	if got := sentEmails(t).Sent(); len(got) != 0 {
+		t.Errorf("got %+v, want no reply to a queued message", got)
+	}
+
+	var out bytes.Buffer
+	err = srv.runQueue([]string{"approve", fmt.Sprint(queued[0].ID)}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reps int
+	err = db.QueryRow("SELECT count(*) FROM reps JOIN user ON reps.user_id=user.id WHERE user.email='outsider@example.com'").Scan(&reps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reps, 2; got != want {
+		t.Errorf("got %d reps, want %d after approval", got, want)
+	}
+	if email, ok := sentEmails(t).Find("outsider@example.com", "Logged"); !ok || email.Subject != "Success!" {
+		t.Errorf("got %+v, want a success email after approval", sentEmails(t).Sent())
+	}
+	if err := srv.runQueue([]string{"approve", fmt.Sprint(queued[0].ID)}, &out); err == nil {
+		t.Error("got no error approving a message twice")
+	}
+
+	// rejecting deletes the message without running it
+	err = parseAPIRecvTo(srv.Port, "5, 10", "other@example.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err = srv.Store.GetQueuedMessages()
+	if err != nil || len(queued) != 1 {
+		t.Fatalf("got %d queued messages and error %v, want 1", len(queued), err)
+	}
+	err = srv.runQueue([]string{"reject", fmt.Sprint(queued[0].ID)}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countUsers("other@example.com"), 0; got != want {
+		t.Errorf("got %d users, want %d after rejecting", got, want)
+	}
+	if got := sentEmails(t).SentTo("other@example.com"); len(got) != 0 {
+		t.Errorf("got %+v, want no reply to a rejected message", got)
+	}
+	out.Reset()
+	if err := srv.runQueue([]string{"list"}, &out); err != nil || !strings.Contains(out.String(), "no queued messages") {
+		t.Errorf("got %q and error %v, want an empty queue", out.String(), err)
+	}
+}
+
+func TestWebhookAuth(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	defer func(token string, spf bool) { ParseToken, RequireSPF = token, spf }(ParseToken, RequireSPF)
+	ParseToken, RequireSPF = "s3cret", true
+
+	countReps := func() int {
+		var count int
+		err := testDB(srv).QueryRow("SELECT count(*) FROM reps JOIN user ON reps.user_id=user.id WHERE user.email='oc_3@sendgrid.com'").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	before := countReps()
+
+	post := func(path string, spf string) int {
+		form := url.Values{"subject": {"5, 10"}, "from": {"oc_3@sendgrid.com"}, "to": {"situps-pullups@countmyreps.com"}, "SPF": {spf}}
+		resp, err := http.PostForm(fmt.Sprintf("http://127.0.0.1:%d%s", srv.Port, path), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a forged request is refused
+	if got, want := post("/parseapi/index.php", "pass"), http.StatusForbidden; got != want {
+		t.Errorf("got %d, want %d without a token", got, want)
+	}
+	if got, want := post("/parseapi/index.php?token=guess", "pass"), http.StatusForbidden; got != want {
+		t.Errorf("got %d, want %d with the wrong token", got, want)
+	}
+	// so is one too large to be a message
+	size := MaxInboundSize
+	MaxInboundSize = 32
+	if got, want := post("/parseapi/index.php?token=s3cret", "pass"), http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("got %d, want %d over MaxInboundSize", got, want)
+	}
+	MaxInboundSize = size
+	// a real delivery of spoofed mail gets a 200 so it is not retried, but is not counted
+	if got, want := post("/parseapi/index.php?token=s3cret", "fail"), http.StatusOK; got != want {
+		t.Errorf("got %d, want %d for a failed SPF check", got, want)
+	}
+	if got, want := countReps(), before; got != want {
+		t.Errorf("got %d reps, want %d after rejected requests", got, want)
+	}
+	if got := sentEmails(t).Sent(); len(got) != 0 {
+		t.Errorf("got %+v, want no replies to rejected requests", got)
+	}
+
+	if got, want := post("/parseapi/index.php?token=s3cret", "pass"), http.StatusOK; got != want {
+		t.Errorf("got %d, want %d with the token", got, want)
+	}
+	if got, want := countReps(), before+2; got != want {
+		t.Errorf("got %d reps, want %d after a verified request", got, want)
+	}
+	if got, want := len(sentEmails(t).SentTo("oc_3@sendgrid.com")), 1; got != want {
+		t.Errorf("got %d, want %d replies after a verified request", got, want)
+	}
+}
+
+func TestRawEmail(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	// with raw mode on, SendGrid only sends the full message (and the SPF and dkim results)
+	raw := "From: =?UTF-8?Q?Oc_Thr=C3=A9e?= <oc_3@sendgrid.com>\r\n" +
+		"To: situps-pullups@countmyreps.com\r\n" +
+		"Subject: =?UTF-8?B?UmU6IHJlcHMg8J+Sqg==?=\r\n" +
+		"Message-ID: <raw@mail.example.com>\r\n" +
+		"Content-Type: multipart/alternative; boundary=sep\r\n\r\n" +
+		"--sep\r\nContent-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"Team Add: early_birds\r\n6, 2\r\n\r\nEnvoy=E9 de mon t=E9l=E9phone\r\n" +
+		"--sep\r\nContent-Type: text/html\r\n\r\n<p>Team Add: early_birds</p><p>6, 2</p>\r\n--sep--\r\n"
+	for i := 0; i < 2; i++ {
+		err := parseAPIPost(srv.Port, url.Values{"email": {raw}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !contains("early_birds", srv.Store.GetUserTeams("oc_3@sendgrid.com")) {
+		t.Errorf("got teams %v, want early_birds from the raw body", srv.Store.GetUserTeams("oc_3@sendgrid.com"))
+	}
+	var submissions int
+	err := testDB(srv).QueryRow("SELECT count(*) FROM submission WHERE message_id='<raw@mail.example.com>'").Scan(&submissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the Message-ID comes from the raw headers, so the redelivery is skipped
+	if got, want := submissions, 1; got != want {
+		t.Errorf("got %d submissions, want %d", got, want)
+	}
+}
+
+func TestInboundProviders(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+
+	for _, test := range inboundFixtures {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "inbound", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d%s", srv.Port, test.path), test.contentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("%s: got %d, want %d", test.path, got, want)
+		}
+	}
+
+	// each provider logged its reps, with where it came from
+	rows, err := db.Query("SELECT source, count(*) FROM submission WHERE sender='oc_3@sendgrid.com' GROUP BY source ORDER BY source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var sources []string
+	for rows.Next() {
+		var source string
+		var count int
+		if err := rows.Scan(&source, &count); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, fmt.Sprintf("%s:%d", source, count))
+	}
+	if got, want := strings.Join(sources, " "), "json:1 mailgun:1 postmark:1 sendgrid:1"; got != want {
+		t.Errorf("got submissions %s, want %s", got, want)
+	}
+	// the json fixture also has a command in its html body
+	if !contains("early_birds", srv.Store.GetUserTeams("oc_3@sendgrid.com")) {
+		t.Errorf("got teams %v, want early_birds", srv.Store.GetUserTeams("oc_3@sendgrid.com"))
+	}
+
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/inbound/postmark", srv.Port), "application/json", strings.NewReader("{not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("got %d, want %d for malformed json", got, want)
+	}
+}
+
+func TestSMTPListener(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+
+	m, err := NewSMTPServer(srv, "127.0.0.1", 0, []string{EmailDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	go m.Serve()
+	addr := fmt.Sprintf("127.0.0.1:%d", m.Port)
+
+	msg := "From: Oc Three <oc_3@sendgrid.com>\r\n" +
+		"To: Reps <situps-pullups@countmyreps.com>\r\n" +
+		"Subject: 5, 10\r\n" +
+		"Message-ID: <smtp-fixture@mail.sendgrid.com>\r\n\r\n" +
+		"Team Add: early_birds\r\n.leading dot\r\n"
+	err = smtp.SendMail(addr, nil, "oc_3@sendgrid.com", []string{"situps-pullups@countmyreps.com"}, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var source string
+	err = testDB(srv).QueryRow("SELECT source FROM submission WHERE message_id='<smtp-fixture@mail.sendgrid.com>'").Scan(&source)
+	if err != nil {
+		t.Fatalf("unable to find the smtp submission: %v", err)
+	}
+	if got, want := source, SourceSMTP; got != want {
+		t.Errorf("got source %q, want %q", got, want)
+	}
+	if !contains("early_birds", srv.Store.GetUserTeams("oc_3@sendgrid.com")) {
+		t.Errorf("got teams %v, want early_birds from the smtp body", srv.Store.GetUserTeams("oc_3@sendgrid.com"))
+	}
+
+	// the sender is the envelope's, not whatever the From header claims
+	spoof := "From: oc_1@sendgrid.com\r\nTo: situps-pullups@countmyreps.com\r\nSubject: 5, 10\r\nMessage-ID: <smtp-spoof@mail.example.com>\r\n\r\n"
+	err = smtp.SendMail(addr, nil, "outsider@example.com", []string{"situps-pullups@countmyreps.com"}, []byte(spoof))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spoofed int
+	err = testDB(srv).QueryRow("SELECT count(*) FROM submission WHERE message_id='<smtp-spoof@mail.example.com>'").Scan(&spoofed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spoofed != 0 {
+		t.Errorf("got %d submissions, want none from an outsider with an allowed From header", spoofed)
+	}
+
+	// the listener is not an open relay, and takes one recipient at a time
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("oc_3@sendgrid.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("someone@example.com"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("got %v, want a 550 for another domain", err)
+	}
+	if err := c.Rcpt("pullups@countmyreps.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("situps@countmyreps.com"); err == nil || !strings.HasPrefix(err.Error(), "452") {
+		t.Errorf("got %v, want a 452 for a second recipient", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	defer func(emailer Emailer, attempts int, token string) {
+		EmailSender, OutboxMaxAttempts, AdminToken = emailer, attempts, token
+	}(EmailSender, OutboxMaxAttempts, AdminToken)
+	OutboxMaxAttempts, AdminToken = 3, "adm1n"
+
+	// replies go to the outbox instead of the mail provider
+	EmailSender = OutboxEmailer{Store: srv.Store}
+	err := parseAPIRecvTo(srv.Port, "5, 10", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	due, err := srv.Store.GetDueOutboxEmails(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || due[0].To != "oc_3@sendgrid.com" || due[0].Subject != "Success!" {
+		t.Fatalf("got %+v, want the success email in the outbox", due)
+	}
+
+	// a failure is retried after the backoff, and gives up after OutboxMaxAttempts
+	outbox := NewOutbox(srv.Store, FakeEmailer{Err: fmt.Errorf("provider is down")})
+	for attempt := 1; attempt <= OutboxMaxAttempts; attempt++ {
+		sent, err := outbox.SendDue(now)
+		if err != nil || sent != 0 {
+			t.Fatalf("attempt %d: got %d sent and error %v, want 0 sent", attempt, sent, err)
+		}
+		if due, _ := srv.Store.GetDueOutboxEmails(now); len(due) != 0 {
+			t.Errorf("attempt %d: got %d due right after failing, want 0", attempt, len(due))
+		}
+		now = now.Add(outboxBackoff(attempt))
+	}
+	stuck, err := srv.Store.GetStuckOutboxEmails()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stuck) != 1 || stuck[0].Status != OutboxDead || stuck[0].Attempts != OutboxMaxAttempts || stuck[0].LastError != "provider is down" {
+		t.Fatalf("got %+v, want one dead email", stuck)
+	}
+	if due, _ := srv.Store.GetDueOutboxEmails(now.Add(24 * time.Hour)); len(due) != 0 {
+		t.Errorf("got %d due, want a dead email never retried", len(due))
+	}
+
+	// the admin endpoint lists it
+	resp, err := getResponse(srv.Port, "/admin/outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.code, http.StatusUnauthorized; got != want {
+		t.Errorf("got %d, want %d without the admin token", got, want)
+	}
+	// the token isn't taken from the url, where it would end up in access logs
+	resp, err = getResponse(srv.Port, "/admin/outbox?token=adm1n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.code, http.StatusUnauthorized; got != want {
+		t.Errorf("got %d, want %d with the token in the url", got, want)
+	}
+	resp, err = getResponseWithHeader(srv.Port, "/admin/outbox", http.Header{"Authorization": {"adm1n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.code, http.StatusUnauthorized; got != want {
+		t.Errorf("got %d, want %d for the token without Bearer", got, want)
+	}
+	resp, err = getResponseWithHeader(srv.Port, "/admin/outbox", http.Header{"Authorization": {"Bearer adm1n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []OutboxEmail
+	if err := json.Unmarshal(resp.body, &listed); err != nil {
+		t.Fatalf("unable to decode %s: %v", resp.body, err)
+	}
+	if len(listed) != 1 || listed[0].ID != stuck[0].ID {
+		t.Errorf("got %+v, want the dead email", listed)
+	}
+
+	// a working provider sends what is due
+	err = OutboxEmailer{Store: srv.Store}.SendEmail("oc_1@sendgrid.com", "Hi", "hi", "<p>hi</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Sender = FakeEmailer{}
+	sent, err := outbox.SendDue(time.Now())
+	if err != nil || sent != 1 {
+		t.Errorf("got %d sent and error %v, want 1", sent, err)
+	}
+	if due, _ := srv.Store.GetDueOutboxEmails(time.Now().Add(time.Hour)); len(due) != 0 {
+		t.Errorf("got %d due after sending, want 0", len(due))
+	}
+
+	// only one server gets to send a due email, and the other gets it back if that one never finishes
+	err = OutboxEmailer{Store: srv.Store}.SendEmail("oc_2@sendgrid.com", "Hi", "hi", "<p>hi</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = time.Now()
+	due, err = srv.Store.GetDueOutboxEmails(now)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("got %+v and error %v, want one due email", due, err)
+	}
+	for i, want := range []bool{true, false} {
+		if claimed, err := srv.Store.ClaimOutboxEmail(due[0].ID, now, now.Add(outboxClaimLease)); err != nil || claimed != want {
+			t.Errorf("claim %d: got %t and error %v, want %t", i+1, claimed, err, want)
+		}
+	}
+	if sent, err := outbox.SendDue(now); err != nil || sent != 0 {
+		t.Errorf("got %d sent and error %v, want the claimed email skipped", sent, err)
+	}
+	if sent, err := outbox.SendDue(now.Add(outboxClaimLease + time.Second)); err != nil || sent != 1 {
+		t.Errorf("got %d sent and error %v, want the email sent once the claim ran out", sent, err)
+	}
+
+	// sent emails are deleted after OutboxSentTTL, and dead ones are kept
+	if err := NewJanitor(srv.Store).Prune(time.Now().Add(OutboxSentTTL + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	rows, err := testDB(srv).Query("SELECT status FROM outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, status)
+	}
+	if len(left) != 1 || left[0] != OutboxDead {
+		t.Errorf("got %v left in the outbox, want only the dead email", left)
+	}
+}
+
+func TestDigests(t *testing.T) {
+	srv := setup()
+	defer teardown(srv)
+	db := testDB(srv)
+	defer func(hour int, weekday time.Weekday) { DigestHour, DigestWeekday = hour, weekday }(DigestHour, DigestWeekday)
+
+	loc := srv.Store.GetUserLocation("oc_3@sendgrid.com")
+	today := startOfDay(time.Now(), loc)
+	// send the weekly digest today, whatever day it is
+	DigestHour, DigestWeekday = 7, today.Weekday()
+	_, err := db.Exec("INSERT INTO challenge (name, start_date, end_date) VALUES ('This Month', ?, ?)", today.AddDate(0, 0, -10).Format("2006-01-02"), today.AddDate(0, 0, 3).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, subject := range []string{"Digest: daily, weekly", "Team Add: early_birds", "yesterday: 5, 10"} {
+		err = parseAPIRecvTo(srv.Port, subject, "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", "You will get the daily and weekly digest"); !ok {
+		t.Errorf("got %+v, want a notice for the digest", sentEmails(t).Sent())
+	}
+	sentEmails(t).Reset()
+
+	digests := NewDigestScheduler(srv)
+	if sent, err := digests.SendDue(today.Add(6 * time.Hour)); err != nil || sent != 0 {
+		t.Errorf("got %d sent and error %v, want none before DigestHour", sent, err)
+	}
+	// a digest that couldn't be sent is not recorded, so the next poll tries it again
+	sentEmails(t).Err = fmt.Errorf("provider is down")
+	if sent, err := digests.SendDue(today.Add(8 * time.Hour)); err != nil || sent != 0 {
+		t.Errorf("got %d sent and error %v, want none while the provider is down", sent, err)
+	}
+	sentEmails(t).Err = nil
+	sentEmails(t).Reset()
+	if sent, err := digests.SendDue(today.Add(9 * time.Hour)); err != nil || sent != 2 {
+		t.Errorf("got %d sent and error %v, want the daily and weekly digests", sent, err)
+	}
+	if sent, err := digests.SendDue(today.Add(10 * time.Hour)); err != nil || sent != 0 {
+		t.Errorf("got %d sent and error %v, want each digest sent once", sent, err)
+	}
+
+	// only oc_3 opted in
+	if got, want := len(sentEmails(t).Sent()), 2; got != want {
+		t.Fatalf("got %+v, want %d digests", sentEmails(t).Sent(), want)
+	}
+	daily, ok := sentEmails(t).Find("oc_3@sendgrid.com", "Your CountMyReps day: "+today.AddDate(0, 0, -1).Format("Monday, Jan 2"))
+	if !ok {
+		t.Fatalf("got %+v, want a daily digest for yesterday", sentEmails(t).Sent())
+	}
+	for _, want := range []string{"You logged 15 reps for This Month.", "* Sit Ups: 5", "* early_birds is #1 of", "There are 4 days left in This Month"} {
+		if !strings.Contains(daily.Text, want) {
+			t.Errorf("got daily digest without %q:\n%s", want, daily.Text)
+		}
+	}
+	weekly, ok := sentEmails(t).Find("oc_3@sendgrid.com", "Your CountMyReps week: ")
+	if !ok {
+		t.Fatalf("got %+v, want a weekly digest", sentEmails(t).Sent())
+	}
+	for _, want := range []string{"You logged 15 reps for This Month this week.", "#1 early_birds: 15 (your team)"} {
+		if !strings.Contains(weekly.Text, want) {
+			t.Errorf("got weekly digest without %q:\n%s", want, weekly.Text)
+		}
+	}
+
+	// nothing is due once the challenge is over
+	users, err := srv.Store.GetDigestUsers()
+	if err != nil || len(users) != 1 {
+		t.Fatalf("got %+v and error %v, want oc_3 opted in", users, err)
+	}
+	u := users[0]
+	if u.Location.String() != loc.String() {
+		t.Errorf("got timezone %s, want %s like GetUserLocation", u.Location, loc)
+	}
+	if ok, err := srv.SendDailyDigest(u, today.AddDate(0, 0, 30)); ok || err != nil {
+		t.Errorf("got %t and error %v, want no daily digest after the challenge", ok, err)
+	}
+	if ok, err := srv.SendWeeklyDigest(u, today.AddDate(0, 0, 28)); ok || err != nil {
+		t.Errorf("got %t and error %v, want no weekly digest after the challenge", ok, err)
+	}
+
+	err = parseAPIRecvTo(srv.Port, "Digest: hourly", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sentEmails(t).Find("oc_3@sendgrid.com", fmt.Sprintf(ErrDigestFmt, "hourly")); !ok {
+		t.Errorf("got %+v, want an error email for an unknown digest", sentEmails(t).Sent())
+	}
+	err = parseAPIRecvTo(srv.Port, "Digest: off", "oc_3@sendgrid.com", "situps-pullups@countmyreps.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users, err = srv.Store.GetDigestUsers(); err != nil || len(users) != 0 {
+		t.Errorf("got %+v and error %v, want no one opted in", users, err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EmailDomain is the domain that receives submissions; the local part of the address lists the exercises
+const EmailDomain = "countmyreps.com"
+
+// Exercise is an entry in the exercise catalog (the exercise table)
+type Exercise struct {
+	ID           int
+	Name         string
+	Aliases      []string
+	DisplayOrder int
+	Active       bool
+}
+
+// Exercises is the active exercise catalog in display order, populated from the db at start up
+var Exercises []Exercise
+
+// Word is how the exercise is written in the local part of a recipient address, ie, "Pull Ups" is "pullups"
+func (e Exercise) Word() string {
+	return addrWord(e.Name)
+}
+
+// addrWord lowercases and strips everything that can't easily go in an email address
+func addrWord(s string) string {
+	var rns []rune
+	for _, r := range strings.ToLower(s) {
+		if strings.ContainsRune("abcdefghijklmnopqrstuvwxyz1234567890", r) {
+			rns = append(rns, r)
+		}
+	}
+	return string(rns)
+}
+
+// exerciseByWord finds the active exercise with the given name or alias
+func exerciseByWord(word string) (Exercise, bool) {
+	word = addrWord(word)
+	for _, e := range Exercises {
+		if e.Word() == word {
+			return e, true
+		}
+		for _, alias := range e.Aliases {
+			if addrWord(alias) == word {
+				return e, true
+			}
+		}
+	}
+	return Exercise{}, false
+}
+
+// exerciseNames lists the active exercise names in display order
+func exerciseNames() []string {
+	names := make([]string, len(Exercises))
+	for i, e := range Exercises {
+		names[i] = e.Name
+	}
+	return names
+}
+
+// exerciseWords lists the active exercises as they are written in an address, ie, pullups, pushups
+func exerciseWords() []string {
+	words := make([]string, len(Exercises))
+	for i, e := range Exercises {
+		words[i] = e.Word()
+	}
+	return words
+}
+
+// exercisesFromAddr determines the ordered list of exercises from the recipient address
+// situps-pullups@countmyreps.com gives [Sit Ups, Pull Ups]
+func exercisesFromAddr(to string) ([]string, error) {
+	addr := strings.ToLower(strings.TrimSpace(extractEmailAddr(to)))
+	parts := strings.Split(addr, "@")
+	if len(parts) != 2 || parts[1] != EmailDomain || parts[0] == "" {
+		return nil, fmt.Errorf("%q is not a %s address", addr, EmailDomain)
+	}
+
+	var exercises []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Split(parts[0], "-") {
+		exercise, ok := exerciseByWord(word)
+		if !ok {
+			return nil, fmt.Errorf("unknown exercise %q in %q", word, addr)
+		}
+		if seen[exercise.Name] {
+			return nil, fmt.Errorf("exercise %q listed more than once in %q", word, addr)
+		}
+		seen[exercise.Name] = true
+		exercises = append(exercises, exercise.Name)
+	}
+	return exercises, nil
+}
+
+// isRepSubject reports if the subject is only comma separated numbers, ie, it is trying to log reps
+func isRepSubject(subject string) bool {
+	for _, part := range strings.Split(subject, ",") {
+		if _, err := strconv.Atoi(strings.TrimSpace(part)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRepCounts pairs the numbers in the subject with the exercises, in order
+func parseRepCounts(subject string, exercises []string) (map[string]int, error) {
+	parts := strings.Split(subject, ",")
+	if len(parts) != len(exercises) {
+		return nil, fmt.Errorf("expected %d numbers, got %d", len(exercises), len(parts))
+	}
+	counts := make(map[string]int)
+	for i, part := range parts {
+		count, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert %s to int", part)
+		}
+		// protect against tricky people who spoof negative reps to other folks
+		if count < 0 {
+			count = -1 * count
+		}
+		counts[exercises[i]] = count
+	}
+	return counts, nil
+}
+
+// isNamedRepSubject reports if the subject is trying to log reps by name, ie, "pushups 20, squats 30" or "20 pushups".
+// Any part with a number or an exercise name counts, so mistakes get a precise error from parseNamedRepCounts.
+func isNamedRepSubject(subject string) bool {
+	if strings.Contains(subject, ":") || isRepSubject(subject) {
+		return false
+	}
+	for _, part := range strings.Split(subject, ",") {
+		for _, field := range strings.Fields(part) {
+			if _, err := strconv.Atoi(field); err == nil {
+				return true
+			}
+		}
+	}
+	return namesExercise(subject)
+}
+
+// namesExercise reports if any comma separated part of the subject names an exercise in the catalog, ie, "pushups 20" or "pushups twenty"
+func namesExercise(subject string) bool {
+	for _, part := range strings.Split(subject, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		// the exercise may be the whole part, or all but a mistyped count at either end
+		for _, name := range []string{part, strings.Join(fields[1:], " "), strings.Join(fields[:len(fields)-1], " ")} {
+			if _, ok := exerciseByWord(name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseNamedRepCounts reads each comma separated "exercise count" or "count exercise" in the subject.
+// The error names what could not be read, ie, `the exercise "burpes"`, for use with ErrNamedRepFmt.
+func parseNamedRepCounts(subject string) ([]string, map[string]int, error) {
+	var exercises []string
+	counts := make(map[string]int)
+	for _, part := range strings.Split(subject, ",") {
+		exercise, count, err := parseNamedRep(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := counts[exercise]; ok {
+			return nil, nil, fmt.Errorf("%q, because %s is listed more than once", strings.TrimSpace(part), exercise)
+		}
+		exercises = append(exercises, exercise)
+		counts[exercise] = count
+	}
+	return exercises, counts, nil
+}
+
+// parseNamedRep reads a single "pushups 20" or "20 pushups"
+func parseNamedRep(part string) (string, int, error) {
+	part = strings.TrimSpace(part)
+	fields := strings.Fields(part)
+	if len(fields) == 0 {
+		return "", 0, fmt.Errorf("an empty entry")
+	}
+
+	// the count goes either last or first
+	first, firstErr := strconv.Atoi(fields[0])
+	last, lastErr := strconv.Atoi(fields[len(fields)-1])
+	var count int
+	var name []string
+	switch {
+	case len(fields) == 1 && firstErr == nil:
+		return "", 0, fmt.Errorf("%q without an exercise", part)
+	case lastErr == nil:
+		count, name = last, fields[:len(fields)-1]
+	case firstErr == nil:
+		count, name = first, fields[1:]
+	default:
+		// no count; point at the word that should have been one
+		if _, ok := exerciseByWord(part); ok {
+			return "", 0, fmt.Errorf("a count for %q", part)
+		}
+		if _, ok := exerciseByWord(strings.Join(fields[:len(fields)-1], " ")); ok {
+			return "", 0, fmt.Errorf("%q as a number", fields[len(fields)-1])
+		}
+		if _, ok := exerciseByWord(strings.Join(fields[1:], " ")); ok {
+			return "", 0, fmt.Errorf("%q as a number", fields[0])
+		}
+		return "", 0, fmt.Errorf("%q", part)
+	}
+
+	exercise, ok := exerciseByWord(strings.Join(name, " "))
+	if !ok {
+		return "", 0, fmt.Errorf("the exercise %q", strings.Join(name, " "))
+	}
+	// same protection against negative reps as parseRepCounts
+	if count < 0 {
+		count = -1 * count
+	}
+	return exercise.Name, count, nil
+}
+
+// d3Freq formats the exercise counts as the freq object used by the d3 dashboard; every given exercise is present
+func d3Freq(counts map[string]int, exercises []string) string {
+	freq := make(map[string]int)
+	for _, name := range exercises {
+		freq[name] = counts[name]
+	}
+	b, err := json.Marshal(freq)
+	if err != nil {
+		logError(nil, err, "unable to marshal exercise counts")
+		return "{}"
+	}
+	return string(b)
+}
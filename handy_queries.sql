@@ -1,2 +1,5 @@
 -- number of participants, where subquery shows who did the most reps
 select count(*) from (select email, sum(reps.count) as total_reps from reps join user on user_id=user.id where reps.created_at > '2017-10-31' and reps.created_at < '2017-12-01' group by user_id order by total_reps desc) as foo;
+
+-- attribute reps to the challenge that was running when they were created (backfill for reps logged before the challenge table)
+update reps join challenge on date(reps.created_at) >= challenge.start_date and date(reps.created_at) <= challenge.end_date set reps.challenge_id = challenge.id where reps.challenge_id is null;
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// InboundAdapter reads a mail provider's inbound webhook into an inboundMessage, so every provider feeds the same commands
+type InboundAdapter interface {
+	// Parse reads the message from the request. It sets Source, and SPF and DKIM when the provider reports them.
+	Parse(r *http.Request) (inboundMessage, error)
+}
+
+// SendGridAdapter reads SendGrid's Inbound Parse form, in either the parsed or the raw MIME mode
+type SendGridAdapter struct{}
+
+// Parse reads the to, from, subject, text, and headers fields, or the email field in raw mode
+func (SendGridAdapter) Parse(r *http.Request) (inboundMessage, error) {
+	msg := inboundMessage{
+		To:        r.PostFormValue("to"),
+		From:      r.PostFormValue("from"),
+		Subject:   r.PostFormValue("subject"),
+		Text:      r.PostFormValue("text"),
+		MessageID: messageIDFromHeaders(r.PostFormValue("headers")),
+	}
+
+	// with "POST the raw, full MIME message" turned on, the message is in the email field instead
+	if raw := r.PostFormValue("email"); raw != "" {
+		parsed, err := parseRawEmail(raw)
+		if err != nil {
+			logError(r, err, "unable to parse raw email; using the form fields")
+		} else {
+			msg = parsed
+		}
+	}
+
+	msg.Source = SourceSendGrid
+	msg.SPF = r.PostFormValue("SPF")
+	msg.DKIM = r.PostFormValue("dkim")
+	return msg, nil
+}
+
+// MailgunAdapter reads the form Mailgun posts for a route that forwards to a url
+type MailgunAdapter struct{}
+
+// dkimDomain finds the signing domain, ie, d=sendgrid.com, in a DKIM-Signature header
+var dkimDomain = regexp.MustCompile(`(?:^|;)\s*d=([^;\s]+)`)
+
+// Parse reads the recipient the route matched, the from and subject headers, the plain body, and Mailgun's SPF and DKIM checks
+func (MailgunAdapter) Parse(r *http.Request) (inboundMessage, error) {
+	msg := inboundMessage{
+		To:        r.PostFormValue("recipient"),
+		From:      r.PostFormValue("from"),
+		Subject:   r.PostFormValue("subject"),
+		Text:      r.PostFormValue("body-plain"),
+		MessageID: strings.TrimSpace(r.PostFormValue("Message-Id")),
+		Source:    SourceMailgun,
+	}
+	if msg.To == "" {
+		msg.To = r.PostFormValue("To")
+	}
+
+	// message-headers is a JSON list of [name, value] pairs
+	var headers [][2]string
+	if raw := r.PostFormValue("message-headers"); raw != "" {
+		err := json.Unmarshal([]byte(raw), &headers)
+		if err != nil {
+			return msg, errors.Wrap(err, "unable to decode message-headers")
+		}
+	}
+	var dkimResult, signer string
+	for _, header := range headers {
+		switch strings.ToLower(header[0]) {
+		case "x-mailgun-spf":
+			msg.SPF = strings.ToLower(header[1])
+		case "x-mailgun-dkim-check-result":
+			dkimResult = strings.ToLower(header[1])
+		case "dkim-signature":
+			if m := dkimDomain.FindStringSubmatch(header[1]); m != nil && signer == "" {
+				signer = m[1]
+			}
+		case "message-id":
+			if msg.MessageID == "" {
+				msg.MessageID = strings.TrimSpace(header[1])
+			}
+		}
+	}
+	// in the same form as SendGrid's dkim field, for verifySender
+	if signer != "" && dkimResult != "" {
+		msg.DKIM = fmt.Sprintf("{@%s : %s}", signer, dkimResult)
+	}
+	return msg, nil
+}
+
+// PostmarkAdapter reads Postmark's inbound webhook JSON
+type PostmarkAdapter struct{}
+
+// postmarkInbound is the part of Postmark's inbound JSON we use
+type postmarkInbound struct {
+	From     string
+	FromFull struct {
+		Email string
+		Name  string
+	}
+	To                string
+	OriginalRecipient string
+	Subject           string
+	// MessageID is Postmark's id; the sender's Message-ID is in Headers
+	MessageID string
+	TextBody  string
+	HtmlBody  string
+	Headers   []struct {
+		Name  string
+		Value string
+	}
+}
+
+// Parse reads the original recipient, sender, subject, and text body (or the html body, if there is no text), and the Received-SPF header
+func (PostmarkAdapter) Parse(r *http.Request) (inboundMessage, error) {
+	var in postmarkInbound
+	err := json.NewDecoder(r.Body).Decode(&in)
+	if err != nil {
+		return inboundMessage{}, errors.Wrap(err, "unable to decode postmark json")
+	}
+
+	msg := inboundMessage{
+		To:      in.OriginalRecipient,
+		From:    in.FromFull.Email,
+		Subject: in.Subject,
+		Text:    in.TextBody,
+		Source:  SourcePostmark,
+	}
+	if msg.To == "" {
+		msg.To = in.To
+	}
+	if msg.From == "" {
+		msg.From = in.From
+	}
+	if strings.TrimSpace(msg.Text) == "" {
+		msg.Text = htmlToText(in.HtmlBody)
+	}
+	for _, header := range in.Headers {
+		switch strings.ToLower(header.Name) {
+		case "message-id":
+			msg.MessageID = strings.TrimSpace(header.Value)
+		case "received-spf":
+			// ie, "Pass (sender SPF authorized) identity=mailfrom; ..."
+			if fields := strings.Fields(header.Value); len(fields) > 0 {
+				msg.SPF = strings.ToLower(fields[0])
+			}
+		}
+	}
+	// Postmark's id is the same on a retry, so it works for skipping redeliveries too
+	if msg.MessageID == "" {
+		msg.MessageID = in.MessageID
+	}
+	return msg, nil
+}
+
+// JSONAdapter reads a plain JSON object, for any other provider or a script
+type JSONAdapter struct{}
+
+// jsonInbound is the body JSONAdapter expects. Only to, from, and subject or text are needed.
+type jsonInbound struct {
+	To        string `json:"to"`
+	From      string `json:"from"`
+	Subject   string `json:"subject"`
+	Text      string `json:"text"`
+	HTML      string `json:"html"`
+	MessageID string `json:"message_id"`
+	SPF       string `json:"spf"`
+	DKIM      string `json:"dkim"`
+}
+
+// Parse decodes the JSON body
+func (JSONAdapter) Parse(r *http.Request) (inboundMessage, error) {
+	var in jsonInbound
+	err := json.NewDecoder(r.Body).Decode(&in)
+	if err != nil {
+		return inboundMessage{}, errors.Wrap(err, "unable to decode json")
+	}
+	msg := inboundMessage{
+		To:        in.To,
+		From:      in.From,
+		Subject:   in.Subject,
+		Text:      in.Text,
+		MessageID: strings.TrimSpace(in.MessageID),
+		SPF:       in.SPF,
+		DKIM:      in.DKIM,
+		Source:    SourceJSON,
+	}
+	if strings.TrimSpace(msg.Text) == "" {
+		msg.Text = htmlToText(in.HTML)
+	}
+	return msg, nil
+}
@@ -1,6 +1,7 @@
 package integration
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/facebookgo/flagenv"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 // Port can be overridden with flags
@@ -18,6 +20,7 @@ var Port int
 
 func TestMain(m *testing.M) {
 	// flag vars
+	var driver, sqlitePath string
 	var mysqlHost, mysqlPort, mysqlUser, mysqlPass, mysqlDBname string
 	var start, end string
 	var overwriteDB, noTearDown bool
@@ -31,6 +34,8 @@ func TestMain(m *testing.M) {
 	flag.StringVar(&start, "start-date", monthStart, "the start date to when querying the db")
 	flag.StringVar(&end, "end-date", monthEnd, "the end date to when querying the db")
 	flag.StringVar(&today, "today-date", today, "the date that we set the world to be for the tests")
+	flag.StringVar(&driver, "driver", "sqlite3", "database to seed; sqlite3 or mysql")
+	flag.StringVar(&sqlitePath, "sqlite-path", "countmyreps_test.db", "sqlite database file")
 	flag.StringVar(&mysqlHost, "mysql-host", "localhost", "mysql host")
 	flag.StringVar(&mysqlPort, "mysql-port", "3306", "mysql port")
 	flag.StringVar(&mysqlUser, "mysql-user", "root", "mysql root")
@@ -43,18 +48,30 @@ func TestMain(m *testing.M) {
 	flagenv.Parse()
 	flag.Parse()
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/", mysqlUser, mysqlPass, mysqlHost, mysqlPort)
-
-	db := SetupDB(dsn, mysqlDBname, overwriteDB)
+	var db *sql.DB
+	var tearDown func()
+	switch driver {
+	case "sqlite3":
+		db = SetupSQLiteDB(sqlitePath)
+		tearDown = func() { TearDownSQLiteDB(db, sqlitePath) }
+	case "mysql":
+		dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/", mysqlUser, mysqlPass, mysqlHost, mysqlPort)
+		db = SetupDB(dsn, mysqlDBname, overwriteDB)
+		tearDown = func() { TearDownDB(db, mysqlDBname) }
+	default:
+		log.Fatalf("unknown driver %q", driver)
+	}
 	err := Seed(db, monthStart, monthEnd, today)
 	if err != nil {
 		log.Fatalf("error seeding data: %v", err)
 	}
+	// TODO - start countmyreps
+	code := m.Run()
+	// os.Exit skips deferred calls, so tear down explicitly
 	if !noTearDown {
-		defer TearDownDB(db, mysqlDBname)
+		tearDown()
 	}
-	// TODO - start countmyreps
-	os.Exit(m.Run())
+	os.Exit(code)
 }
 
 func TestStats(t *testing.T) {
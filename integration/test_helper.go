@@ -3,17 +3,15 @@ package integration
 import (
 	"database/sql"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
-)
 
-// SQLTables is the file in the setup dir
-const SQLTables = "create_db_v2.sql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sethgrid/countmyreps/migrations"
+)
 
 // Debug will make logging verbose
 var Debug bool
@@ -52,41 +50,44 @@ func SetupDB(dsn string, dbname string, overwrite bool) *sql.DB {
 		debugFatalf("unable to create db %s: %v", dbname, err)
 	}
 
-	_, err = db.Exec("use " + dbname)
+	// "use" would only select the database for one connection in the pool, so reconnect with it in the dsn
+	cfg, err := mysql.ParseDSN(dsn)
 	if err != nil {
-		debugFatalf("unable to select database: %v", err)
+		debugFatalf("unable to parse dsn: %v", err)
 	}
-
-	// create tables
-	debugln("ready to create tables")
-
-	dir, err := os.Getwd()
+	cfg.DBName = dbname
+	db.Close()
+	db, err = sql.Open("mysql", cfg.FormatDSN())
 	if err != nil {
-		debugFatal(err)
+		debugFatalf("unable to connect to %s: %v", dbname, err)
 	}
 
-	setupData, err := ioutil.ReadFile(filepath.Join(dir, "..", "setup", SQLTables))
+	migrate(db, migrations.MySQL)
+	return db
+}
+
+// SetupSQLiteDB creates a fresh SQLite database at path. Any existing file is removed first.
+func SetupSQLiteDB(path string) *sql.DB {
+	os.Remove(path)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000", path))
 	if err != nil {
-		setupData, err = ioutil.ReadFile(filepath.Join(dir, "setup", SQLTables))
-		if err != nil {
-			debugf("unable to read setup/%s: %v", SQLTables, err)
-		}
+		debugFatalf("unable to open %s - %v", path, err)
 	}
-
-	createTables := strings.Split(string(setupData), ";")
-	for _, createTable := range createTables {
-		createTable = strings.TrimSpace(createTable)
-		if createTable != "" {
-			_, err = db.Exec(createTable)
-			if err != nil {
-				debugFatalf("unable to create tables: %v\n%s", err, createTable)
-			}
-		}
+	if err := db.Ping(); err != nil {
+		debugFatalf("unable to ping %s - %v", path, err)
 	}
+	migrate(db, migrations.SQLite)
+	return db
+}
 
+// migrate brings the new database up to the latest schema
+func migrate(db *sql.DB, dialect string) {
+	debugln("ready to create tables")
+	_, err := migrations.Up(db, dialect)
+	if err != nil {
+		debugFatalf("unable to create tables: %v", err)
+	}
 	debugln("tables set up")
-
-	return db
 }
 
 // TearDownDB drops the given database
@@ -97,6 +98,14 @@ func TearDownDB(db *sql.DB, dbname string) {
 	}
 }
 
+// TearDownSQLiteDB closes the database and removes its file
+func TearDownSQLiteDB(db *sql.DB, path string) {
+	db.Close()
+	if err := os.Remove(path); err != nil {
+		debugFatalf("unable to remove %s: %v", path, err)
+	}
+}
+
 // Seed populates sample data into the DB
 func Seed(db *sql.DB, monthStart string, monthEnd string, today string) error {
 	OCHeadCount := 4
@@ -105,49 +114,30 @@ func Seed(db *sql.DB, monthStart string, monthEnd string, today string) error {
 	if err != nil {
 		return err
 	}
-	// end, err := time.Parse("2006-01-02", monthEnd)
-	// if err != nil {
-	// 	return err
-	// }
+	end, err := time.Parse("2006-01-02", monthEnd)
+	if err != nil {
+		return err
+	}
 	now, err := time.Parse("2006-01-02", today)
 	if err != nil {
 		return err
 	}
 
-	// create offices
-	debugln("inserting offices")
-	_, err = db.Exec("INSERT INTO office (name, head_count) VALUES ('', 1), ('OC', ?), ('Denver', ?)", OCHeadCount, DenverHeadCount)
+	// create the challenge the seeded reps belong to
+	debugln("inserting challenge")
+	res, err := db.Exec("INSERT INTO challenge (name, start_date, end_date) VALUES (?, ?, ?)", fmt.Sprintf("Movember %d", start.Year()), monthStart, monthEnd)
 	if err != nil {
 		return err
 	}
-
-	// create users
-	var users []User
-	debugln("inserting users")
-	for i := 1; i <= OCHeadCount; i++ {
-		user := fmt.Sprintf("oc_%d@sendgrid.com", i)
-		res, err := db.Exec("INSERT INTO user SET email=?, office=(SELECT id FROM office WHERE name='OC' LIMIT 1)", user)
-		if err != nil {
-			return err
-		}
-		id, err := res.LastInsertId()
-		if err != nil {
-			return err
-		}
-		users = append(users, User{id: id, email: user})
+	challengeID, err := res.LastInsertId()
+	if err != nil {
+		return err
 	}
 
-	for i := 1; i <= DenverHeadCount; i++ {
-		user := fmt.Sprintf("denver_%d@sendgrid.com", i)
-		res, err := db.Exec("INSERT INTO user SET email=?, office=(SELECT id FROM office WHERE name='Denver' LIMIT 1)", user)
-		if err != nil {
-			return err
-		}
-		id, err := res.LastInsertId()
-		if err != nil {
-			return err
-		}
-		users = append(users, User{id: id, email: user})
+	// and last year's, so there is more than one season to browse
+	_, err = db.Exec("INSERT INTO challenge (name, start_date, end_date) VALUES (?, ?, ?)", fmt.Sprintf("Movember %d", start.Year()-1), start.AddDate(-1, 0, 0).Format("2006-01-02"), end.AddDate(-1, 0, 0).Format("2006-01-02"))
+	if err != nil {
+		return err
 	}
 
 	// set up teams
@@ -160,6 +150,42 @@ func Seed(db *sql.DB, monthStart string, monthEnd string, today string) error {
 		}
 	}
 
+	// create offices; they are teams of kind office
+	debugln("inserting offices")
+	_, err = db.Exec("INSERT INTO team (name, kind, head_count, timezone) VALUES ('OC', 'office', ?, 'America/Los_Angeles'), ('Denver', 'office', ?, 'America/Denver')", OCHeadCount, DenverHeadCount)
+	if err != nil {
+		return err
+	}
+
+	// create users
+	var users []User
+	debugln("inserting users")
+	for _, office := range []struct {
+		name      string
+		prefix    string
+		headCount int
+	}{
+		{"OC", "oc", OCHeadCount},
+		{"Denver", "denver", DenverHeadCount},
+	} {
+		for i := 1; i <= office.headCount; i++ {
+			user := fmt.Sprintf("%s_%d@sendgrid.com", office.prefix, i)
+			res, err := db.Exec("INSERT INTO user (email) VALUES (?)", user)
+			if err != nil {
+				return err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec("INSERT INTO user_team (user_id, team_id) VALUES (?, (SELECT id FROM team WHERE name=? AND kind='office'))", id, office.name)
+			if err != nil {
+				return err
+			}
+			users = append(users, User{id: id, email: user})
+		}
+	}
+
 	// set up user to team relationships
 	debugln("relating users to teams")
 	// set oc_1 and oc_2 to eng, mp, crossfit. set oc_2 to sales.
@@ -179,11 +205,11 @@ func Seed(db *sql.DB, monthStart string, monthEnd string, today string) error {
 			if user.id%2 == 0 {
 				continue
 			}
-			_, err := db.Exec("INSERT INTO reps (exercise, count, user_id, created_at) VALUES ('Pull Ups', ?, ?, ?), ('Push Ups', ?, ?, ?), ('Sit Ups', ?, ?, ?), ('Squats', ?, ?, ?)",
-				int(user.id)*r.Intn(5), user.id, thisDay,
-				int(user.id)*r.Intn(10), user.id, thisDay,
-				int(user.id)*r.Intn(15), user.id, thisDay,
-				int(user.id)*r.Intn(20), user.id, thisDay,
+			_, err := db.Exec("INSERT INTO reps (exercise, count, user_id, created_at, challenge_id) VALUES ('Pull Ups', ?, ?, ?, ?), ('Push Ups', ?, ?, ?, ?), ('Sit Ups', ?, ?, ?, ?), ('Squats', ?, ?, ?, ?)",
+				int(user.id)*r.Intn(5), user.id, thisDay, challengeID,
+				int(user.id)*r.Intn(10), user.id, thisDay, challengeID,
+				int(user.id)*r.Intn(15), user.id, thisDay, challengeID,
+				int(user.id)*r.Intn(20), user.id, thisDay, challengeID,
 			)
 			if err != nil {
 				return err
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProcessedMessageTTL is how long a Message-ID is remembered to skip redeliveries; providers give up retrying well before
+var ProcessedMessageTTL = 7 * 24 * time.Hour
+
+// Janitor is the background worker that deletes rows only needed for a while
+type Janitor struct {
+	Store Store
+	// PollInterval is how often to prune
+	PollInterval time.Duration
+
+	close chan struct{}
+}
+
+// NewJanitor creates a worker that prunes the store
+func NewJanitor(store Store) *Janitor {
+	return &Janitor{
+		Store:        store,
+		PollInterval: time.Hour,
+		close:        make(chan struct{}),
+	}
+}
+
+// Run prunes every PollInterval until Close
+func (j *Janitor) Run() {
+	ticker := time.NewTicker(j.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := j.Prune(time.Now()); err != nil {
+			logError(nil, err, "unable to prune")
+		}
+		select {
+		case <-j.close:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops Run
+func (j *Janitor) Close() error {
+	close(j.close)
+	return nil
+}
+
+// Prune deletes the Message-IDs older than ProcessedMessageTTL and the sent emails older than OutboxSentTTL, as of now
+func (j *Janitor) Prune(now time.Time) error {
+	n, err := j.Store.PruneProcessedMessages(now.Add(-ProcessedMessageTTL))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logEvent(nil, "prune", fmt.Sprintf("forgot %d processed message ids", n))
+	}
+	n, err = j.Store.PruneOutboxEmails(now.Add(-OutboxSentTTL))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logEvent(nil, "prune", fmt.Sprintf("deleted %d sent outbox emails", n))
+	}
+	return nil
+}
@@ -10,14 +10,17 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/facebookgo/flagenv"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sethgrid/countmyreps/migrations"
 )
 
 // ViewTemplate displays /view
@@ -26,11 +29,11 @@ var ViewTemplate *template.Template
 // IndexTemplate displays the index/root
 var IndexTemplate *template.Template
 
-// StartDate is the earliest date we will query in the db
-var StartDate time.Time
-
-// EndDate is the latest date we will query in the db
-var EndDate time.Time
+// EmailHTMLTemplates and EmailTextTemplates are the two parts of each email, ie, success.html and success.txt, from go_templates/email
+var (
+	EmailHTMLTemplates *template.Template
+	EmailTextTemplates *texttemplate.Template
+)
 
 // Offices is all the valid Offices
 var Offices []string
@@ -38,6 +41,9 @@ var Offices []string
 // AppName is the app name
 var AppName = "countmyreps"
 
+// SiteURL is where the site is served, for links and images in emails
+var SiteURL = "http://countmyreps.com"
+
 // Version is the semver
 var Version = "3.1.3"
 
@@ -56,33 +62,10 @@ func init() {
 			return template.JS(s)
 		},
 		// d3ChartData correctly formats []RepData to the JS format so data can display
-		"d3ChartData": func(d []RepData) template.JS {
-			parts := make([]string, len(d))
-			for i, data := range d {
-				parts[i] = fmt.Sprintf("{State:'%s',freq:{pull_up:%d, sit_up:%d, push_up: %d, squat:%d}}",
-					data.Date,
-					data.ExerciseCounts[PullUps],
-					data.ExerciseCounts[SitUps],
-					data.ExerciseCounts[PushUps],
-					data.ExerciseCounts[Squats],
-				)
-			}
-			return template.JS(strings.Join(parts, ",\n"))
-		},
+		"d3ChartData": d3ChartData,
 		// d3ChartDataForOffice is a helper method to avoid complexities with nesting ranges in the template
-		"d3ChartDataForOffice": func(officeName string, reps map[string][]RepData) template.JS {
-			// TODO: DRY up with ^^
-			parts := make([]string, len(reps[officeName]))
-			for i, data := range reps[officeName] {
-				parts[i] = fmt.Sprintf("{State:'%s',freq:{pull_up:%d, sit_up:%d, push_up: %d, squat:%d}}",
-					data.Date,
-					data.ExerciseCounts[PullUps],
-					data.ExerciseCounts[SitUps],
-					data.ExerciseCounts[PushUps],
-					data.ExerciseCounts[Squats],
-				)
-			}
-			return template.JS(strings.Join(parts, ",\n"))
+		"d3ChartDataForOffice": func(exercises []string, officeName string, reps map[string][]RepData) template.JS {
+			return d3ChartData(exercises, reps[officeName])
 		},
 	}
 
@@ -99,15 +82,25 @@ func init() {
 		log.Fatalln(err)
 	}
 
+	// emailFuncs are available to the email templates; html/template escapes everything else they are given
+	emailFuncs := map[string]interface{}{
+		"siteURL": func() string {
+			return strings.TrimSuffix(SiteURL, "/")
+		},
+	}
+	EmailHTMLTemplates, err = template.New("email").Funcs(emailFuncs).ParseGlob(filepath.Join("go_templates", "email", "*.html"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	EmailTextTemplates, err = texttemplate.New("email").Funcs(emailFuncs).ParseGlob(filepath.Join("go_templates", "email", "*.txt"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 }
 
-// We expect the database to have these exact values
-// TODO: it would be interesting to figure out how to have this dynamic (display too) and based off the email they send to
+// Addresses we have historically advertised; any list of exercises from the exercise table is accepted
 const (
-	PullUps  = "Pull Ups"
-	SitUps   = "Sit Ups"
-	PushUps  = "Push Ups"
-	Squats   = "Squats"
 	OldEmail = "pullups-pushups-airsquats-situps@countmyreps.com"
 	NewEmail = "pullups-pushups-squats-situps@countmyreps.com"
 )
@@ -119,45 +112,136 @@ var Debug bool
 var EmailSender Emailer
 
 func main() {
-	var err error
-
 	// flag vars
-	var port int
+	var port, smtpPort int
+	var smtpHost, smtpDomains string
+	var emailer string
+	var relay SMTPEmailer
+	var sqlitePath string
 	var mysqlHost, mysqlPort, mysqlUser, mysqlPass, mysqlDBname string
-	var start, end string
-
-	// defaults for start and end vars
-	startDefault := fmt.Sprintf("%d-11-01", time.Now().Year())
-	endDefault := fmt.Sprintf("%d-11-31", time.Now().Year())
 
 	// get flags
 	flag.IntVar(&port, "port", 9126, "port to run site")
-	flag.StringVar(&start, "start-date", startDefault, "the start date to when querying the db")
-	flag.StringVar(&end, "end-date", endDefault, "the end date to when querying the db")
+	flag.IntVar(&smtpPort, "smtp-port", 0, "if set, also receive mail directly over SMTP on this port")
+	flag.StringVar(&smtpHost, "smtp-host", "127.0.0.1", "address the SMTP listener binds to; it does not check SPF or DKIM, so keep it private")
+	flag.StringVar(&smtpDomains, "smtp-domains", EmailDomain, "comma separated recipient domains the SMTP listener accepts mail for")
+	flag.StringVar(&emailer, "emailer", "sendgrid", "how to send email: sendgrid (with SENDGRID_API_KEY) or smtp (with the smtp-relay flags)")
+	flag.StringVar(&relay.Host, "smtp-relay-host", "", "smtp relay host, for -emailer smtp")
+	flag.IntVar(&relay.Port, "smtp-relay-port", 587, "smtp relay port, for -emailer smtp")
+	flag.StringVar(&relay.Username, "smtp-relay-user", "", "smtp relay username; leave empty for no auth")
+	flag.StringVar(&relay.Password, "smtp-relay-pass", "", "smtp relay password")
+	flag.BoolVar(&relay.StartTLS, "smtp-relay-starttls", true, "require STARTTLS with the smtp relay")
+	flag.StringVar(&SiteURL, "site-url", SiteURL, "where the site is served, for links and images in emails")
+	flag.IntVar(&DigestHour, "digest-hour", DigestHour, "hour of the day, in each user's timezone, after which digest emails are sent")
+	flag.IntVar(&OutboxMaxAttempts, "outbox-max-attempts", OutboxMaxAttempts, "how many times to try sending an email before marking it dead")
+	flag.DurationVar(&OutboxBackoff, "outbox-backoff", OutboxBackoff, "wait before retrying a failed email; doubles with each failure")
+	flag.DurationVar(&OutboxSentTTL, "outbox-sent-ttl", OutboxSentTTL, "how long sent emails are kept in the outbox")
+	flag.StringVar(&AdminToken, "admin-token", "", "token for the /admin endpoints; they are off without one")
+	flag.StringVar(&sqlitePath, "sqlite-path", "", "use this sqlite file instead of mysql")
 	flag.StringVar(&mysqlHost, "mysql-host", "localhost", "mysql host")
 	flag.StringVar(&mysqlPort, "mysql-port", "3306", "mysql port")
 	flag.StringVar(&mysqlUser, "mysql-user", "root", "mysql root")
 	flag.StringVar(&mysqlPass, "mysql-pass", "", "mysql pass")
 	flag.StringVar(&mysqlDBname, "mysql-dbname", "countmyreps", "mysql dbname")
+	flag.StringVar(&DefaultTimezone, "default-timezone", DefaultTimezone, "IANA timezone for users and teams without one")
+	flag.IntVar(&BackdateDays, "backdate-days", BackdateDays, "how many days back a subject like 'yesterday: 5, 10, 15, 20' can credit reps")
+	flag.Var(&AllowedSenders, "allowed-senders", "comma separated domains (example.com), wildcard subdomains (*.example.com), and addresses allowed to send commands; * allows anyone")
+	flag.StringVar(&RejectedSenderPolicy, "rejected-sender", RejectedSenderPolicy, "what to do with mail from other senders: drop, bounce, or queue (for the queue subcommand)")
+	flag.StringVar(&ParseToken, "parse-token", "", "if set, the inbound parse url must have ?token= with this value")
+	flag.StringVar(&ParseHMACSecret, "parse-hmac-secret", "", "if set, inbound parse requests must have an "+SignatureHeader+" header with the hex HMAC-SHA256 of the body")
+	flag.BoolVar(&RequireSPF, "require-spf", false, "drop inbound mail unless its SPF result is pass")
+	flag.BoolVar(&RequireDKIM, "require-dkim", false, "drop inbound mail unless it has a passing DKIM signature from the sender's domain")
+	flag.DurationVar(&UndoWindow, "undo-window", UndoWindow, "how far back the undo subject can remove a submission")
+	flag.DurationVar(&ProcessedMessageTTL, "processed-message-ttl", ProcessedMessageTTL, "how long inbound Message-IDs are kept to skip redeliveries")
 	flag.BoolVar(&Debug, "debug", false, "set flag for verbose logging")
 
 	flagenv.Parse()
 	flag.Parse()
 
-	// validate flags
-	StartDate, err = time.Parse("2006-01-02", start)
-	if err != nil {
-		log.Fatal(err)
+	var sender Emailer
+	switch emailer {
+	case "sendgrid":
+		sender = SendGridEmailer{}
+	case "smtp":
+		if relay.Host == "" {
+			log.Fatal("-emailer smtp needs -smtp-relay-host")
+		}
+		sender = relay
+	default:
+		log.Fatalf("-emailer must be sendgrid or smtp, not %q", emailer)
 	}
-	EndDate, err = time.Parse("2006-01-02", end)
-	if err != nil {
-		log.Fatal(err)
+
+	if !validSenderPolicy(RejectedSenderPolicy) {
+		log.Fatalf("-rejected-sender must be %s, %s, or %s, not %q", SenderDrop, SenderBounce, SenderQueue, RejectedSenderPolicy)
+	}
+	if DigestHour < 0 || DigestHour > 23 {
+		log.Fatalf("-digest-hour must be from 0 to 23, not %d", DigestHour)
+	}
+	// mail received over SMTP has no SPF or DKIM results, so these flags would drop all of it
+	if smtpPort != 0 && (RequireSPF || RequireDKIM) {
+		log.Fatal("-smtp-port does not check SPF or DKIM, so it can't be used with -require-spf or -require-dkim")
+	}
+
+	// countmyreps [flags] migrate up|down|status
+	if flag.Arg(0) == "migrate" {
+		var db *sql.DB
+		dialect := migrations.MySQL
+		if sqlitePath != "" {
+			db, dialect = openSQLite(sqlitePath), migrations.SQLite
+		} else {
+			db = openMySQL(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname)
+		}
+		defer db.Close()
+		if err := runMigrate(db, dialect, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var store Store
+	if sqlitePath != "" {
+		store = SetupSQLiteDB(sqlitePath)
+	} else {
+		store = SetupDB(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname)
+	}
+	// replies go to the outbox, and the worker started below sends them
+	s := NewServer(store, port, OutboxEmailer{Store: store})
+
+	// countmyreps [flags] queue list|approve ID|reject ID
+	if flag.Arg(0) == "queue" {
+		defer store.Close()
+		if err := s.runQueue(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if smtpPort != 0 {
+		m, err := NewSMTPServer(s, smtpHost, smtpPort, strings.Split(smtpDomains, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("receiving smtp on %s:%d for %s; it does not check SPF or DKIM, so only let trusted mail servers reach it", smtpHost, m.Port, smtpDomains)
+		go func() {
+			if err := m.Serve(); err != nil {
+				log.Println("Unexpected error serving smtp: ", err.Error())
+			}
+		}()
 	}
 
-	db := SetupDB(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname)
+	outbox := NewOutbox(store, sender)
+	go outbox.Run()
+	defer outbox.Close()
+
+	digests := NewDigestScheduler(s)
+	go digests.Run()
+	defer digests.Close()
+
+	janitor := NewJanitor(store)
+	go janitor.Run()
+	defer janitor.Close()
 
 	log.Printf("starting on :%d", port)
-	s := NewServer(db, port, SendGridEmailer{})
 
 	if err := s.Serve(); err != nil {
 		log.Println("Unexpected error serving: ", err.Error())
@@ -165,8 +249,30 @@ func main() {
 }
 
 // SetupDB initialized the DB conn and grabs initial data needed for the app (ie, Offices)
-func SetupDB(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname string) *sql.DB {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname))
+func SetupDB(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname string) Store {
+	db := openMySQL(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname)
+	if err := checkSchema(db, migrations.MySQL); err != nil {
+		log.Fatal(err)
+	}
+	store := NewMySQLStore(db)
+	populateVars(store)
+	return store
+}
+
+// SetupSQLiteDB opens the SQLite file and grabs the same initial data as SetupDB
+func SetupSQLiteDB(path string) Store {
+	db := openSQLite(path)
+	if err := checkSchema(db, migrations.SQLite); err != nil {
+		log.Fatal(err)
+	}
+	store := NewSQLiteStore(db)
+	populateVars(store)
+	return store
+}
+
+func openMySQL(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname string) *sql.DB {
+	// keep the session and the driver in UTC so timestamps mean the same thing regardless of the server's timezone
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=UTC&time_zone=%%27%%2B00%%3A00%%27", mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -175,29 +281,48 @@ func SetupDB(mysqlUser, mysqlPass, mysqlHost, mysqlPort, mysqlDBname string) *sq
 		log.Fatal(err)
 	}
 	db.SetConnMaxLifetime(1 * time.Minute)
+	return db
+}
 
-	err = populateOfficesVar(db)
+func openSQLite(path string) *sql.DB {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000", path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Ping()
 	if err != nil {
 		log.Fatal(err)
 	}
 	return db
 }
 
+// populateVars fills in the globals the handlers use, ie, Offices and Exercises
+func populateVars(store Store) {
+	err := populateOfficesVar(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = populateExercisesVar(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 // Server contains the settings needed to run the server
 type Server struct {
-	Port int
-	Mux  *mux.Router
-	DB   *sql.DB
+	Port  int
+	Mux   *mux.Router
+	Store Store
 
 	dbname string
 	close  chan struct{}
 }
 
-// NewServer creates a new server running against the give db
-func NewServer(db *sql.DB, port int, emailer Emailer) *Server {
+// NewServer creates a new server running against the given store
+func NewServer(store Store, port int, emailer Emailer) *Server {
 	s := &Server{}
 	s.Port = port
-	s.DB = db
+	s.Store = store
 	s.close = make(chan struct{})
 	EmailSender = emailer // TODO: should this be on the server? How will that pass down?
 
@@ -206,7 +331,12 @@ func NewServer(db *sql.DB, port int, emailer Emailer) *Server {
 	r.HandleFunc("/view", s.ViewHandler)
 	r.HandleFunc("/json", s.JSONHandler)
 	r.HandleFunc("/healthcheck", s.HealthcheckHandler)
-	r.HandleFunc("/parseapi/index.php", s.ParseHandler)                                // backwards compatibility
+	r.HandleFunc("/admin/outbox", s.OutboxHandler)
+	r.HandleFunc("/parseapi/index.php", s.ParseHandler) // backwards compatibility
+	r.HandleFunc("/inbound/sendgrid", s.InboundHandler(SendGridAdapter{}))
+	r.HandleFunc("/inbound/mailgun", s.InboundHandler(MailgunAdapter{}))
+	r.HandleFunc("/inbound/postmark", s.InboundHandler(PostmarkAdapter{}))
+	r.HandleFunc("/inbound/json", s.InboundHandler(JSONAdapter{}))
 	r.PathPrefix("/").Handler(http.StripPrefix("", http.FileServer(http.Dir("web/")))) // mux specific workaround for fileserver; todo: use separate mux to avoid filtering these endpoints from logs?
 
 	r.Handle("/", mwPanic(mwLog(r)))
@@ -254,138 +384,191 @@ func errorHandler(w http.ResponseWriter, r *http.Request, code int, message stri
 // ParseHandler handles SendGrid's inbound parse api
 func (s *Server) ParseHandler(w http.ResponseWriter, r *http.Request) {
 	// NOTE: SendGrid's Inbound Parse API requires a 200 level response always, even on error, otherwise it will retry
+	s.handleInbound(w, r, SendGridAdapter{})
+}
 
-	// errMsg is parsed later to determine if we should send a success or error email
-	var errMsg string
+// InboundHandler handles a provider's inbound webhook, ie, /inbound/mailgun, with the adapter for it
+func (s *Server) InboundHandler(adapter InboundAdapter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.handleInbound(w, r, adapter)
+	}
+}
+
+// handleInbound verifies the request, reads the message with the adapter, and runs it. Providers retry anything but a 2xx,
+// so only a forged or unreadable request gets an error status.
+func (s *Server) handleInbound(w http.ResponseWriter, r *http.Request, adapter InboundAdapter) {
+	// a request without the right token or signature is not from the provider, so it gets no 200
+	err := verifyWebhook(w, r)
+	if err == errInboundTooLarge {
+		logEvent(r, "security", fmt.Sprintf("rejected inbound request from %s over %d bytes", r.RemoteAddr, MaxInboundSize))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logEvent(r, "security", fmt.Sprintf("rejected inbound request from %s: %v", r.RemoteAddr, err))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	msg, err := adapter.Parse(r)
+	if err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "unable to read inbound message", err)
+		return
+	}
+	msg.ReceivedAt = time.Now()
+	s.receive(r, msg)
+}
+
+// receive checks and runs a message from any source, skipping senders that fail SPF or DKIM and redeliveries
+func (s *Server) receive(r *http.Request, msg inboundMessage) {
+	logEvent(r, "parseapi", fmt.Sprintf("Source: %s, To: %s, From: %s, Subject: %s, Message-ID: %s", msg.Source, msg.To, msg.From, msg.Subject, msg.MessageID))
+
+	// a spoofed sender is dropped without an error, since the provider would only deliver it again
+	if err := verifySender(msg.From, msg.SPF, msg.DKIM); err != nil {
+		logEvent(r, "security", fmt.Sprintf("dropped message from %s: %v", msg.From, err))
+		return
+	}
+
+	// a redelivery of a message we already handled is accepted again, without counting or emailing again
+	if msg.MessageID != "" {
+		processed, err := s.Store.IsMessageProcessed(msg.MessageID)
+		if err != nil {
+			// better to risk counting a redelivery than to drop the message
+			logError(r, err, "unable to look up message id")
+		} else if processed {
+			logEvent(r, "duplicate_message", fmt.Sprintf("already processed %s from %s", msg.MessageID, msg.From))
+			return
+		}
+	}
+
+	// the Message-ID is only used up once the message is handled, so a redelivery after a database error runs again
+	if s.processMessage(r, msg, false) || msg.MessageID == "" {
+		return
+	}
+	if _, err := s.Store.MarkMessageProcessed(msg.MessageID); err != nil {
+		logError(r, err, "unable to record message id")
+	}
+}
+
+// processMessage runs the commands in the email and replies. Senders not on the allowlist are handled by
+// RejectedSenderPolicy, unless approved is set because an admin let the message through the queue.
+// It reports unexpected if a database error kept a command from running.
+func (s *Server) processMessage(r *http.Request, msg inboundMessage, approved bool) (unexpected bool) {
+	// errMsgs are checked later to determine if we should send a success or error email
+	var errMsgs []string
+	// notices say what each command did, for the top of the success email
+	var notices []string
 	var err error
 
-	to := r.PostFormValue("to")
-	from := r.PostFormValue("from")
-	subject := r.PostFormValue("subject")
+	to, from, subject, text := msg.To, msg.From, msg.Subject, msg.Text
 
-	logEvent(r, "parseapi", fmt.Sprintf("To: %s, From: %s, Subject: %s", to, from, subject))
+	// exercises is determined by the recipient address, ie, situps-pullups@countmyreps.com
+	var exercises []string
+	// reports are sent as their own emails, ie, for "stats", and skipReply is set when they are the only reply
+	var reports []string
+	var skipReply bool
 
 	defer func() {
+		for _, report := range reports {
+			if err := s.SendReportEmail(from, report); err != nil {
+				logError(r, err, "unable to send report email: "+report)
+			}
+		}
+		if skipReply {
+			return
+		}
+
 		var mailType string
-		if errMsg != "" {
-			mailType = "error - " + errMsg
+		if len(errMsgs) > 0 {
+			mailType = "error - " + strings.Join(errMsgs, "; ")
 			// we don't want to send out a bunch of responses to spam hitting the server
-			// only send a response if the subject looked vaguely correct or the sender was from sendgrid.
+			// only send a response if the subject looked vaguely correct or the sender is allowed.
 			parts := strings.Split(subject, ",")
-			if strings.Contains(from, "@sendgrid.com") || len(parts) == 4 {
-				err = s.SendErrorEmail(from, to, subject, errMsg)
+			if approved || AllowedSenders.Allows(from) || (len(exercises) > 0 && len(parts) == len(exercises)) {
+				err = s.SendErrorEmail(from, to, subject, errMsgs...)
 			}
 		} else {
 			mailType = "success"
-			err = s.SendSuccessEmail(from)
+			err = s.SendSuccessEmail(from, notices...)
 		}
 		if err != nil {
 			logError(r, err, "unable to send response email: "+mailType)
 		}
 	}()
 
-	if to == "" || from == "" || subject == "" {
+	if to == "" || from == "" || (subject == "" && strings.TrimSpace(text) == "") {
 		logEvent(r, "bad_parse", "unable to determine to or from or subject")
-		errMsg = fmt.Sprintf(ErrUnexpectedFmt, fmt.Sprintf("Missing to, from, or subject: %q, %q, %q", to, from, subject))
+		errMsgs = []string{fmt.Sprintf(ErrUnexpectedFmt, fmt.Sprintf("Missing to, from, or subject: %q, %q, %q", to, from, subject))}
 		return
 	}
 
 	from = extractEmailAddr(from)
+	msg.From = from
 
-	if !strings.Contains(from, "@sendgrid.com") {
-		logEvent(r, "bad_parse", fmt.Sprintf("sender not from sendgrid - %s", from))
-		errMsg = fmt.Sprintf(ErrToAddrFmt, from)
+	if !approved && !AllowedSenders.Allows(from) {
+		skipReply = true
+		s.rejectSender(r, msg)
 		return
 	}
 
-	if !(extractEmailAddr(to) == NewEmail || extractEmailAddr(to) == OldEmail) {
-		logEvent(r, "bad_parse", fmt.Sprintf("recipient not valid countmyreps address: %s", to))
-		errMsg = fmt.Sprintf(ErrToAddrFmt, to)
-		return
+	// commands come from the subject and each line of the body. Phones mangle subjects, so a subject
+	// that is not a command is only an error when the body has no commands either.
+	var lines []string
+	var bodyCommands []string
+	for _, line := range bodyLines(text) {
+		// some clients repeat the subject as the first line of the body
+		if isBodyCommand(line) && !strings.EqualFold(line, strings.TrimSpace(subject)) {
+			bodyCommands = append(bodyCommands, line)
+		}
+	}
+	if isCommand(subject) || len(bodyCommands) == 0 {
+		lines = append(lines, subject)
 	}
+	lines = append(lines, bodyCommands...)
 
-	userID, err := getOrCreateUserID(s.DB, from)
-	if err != nil {
-		logError(r, err, "unable to create/get user")
-		errMsg = fmt.Sprintf(ErrUnexpectedFmt, "unable to create and/or get user")
+	// reports (stats and help) only read, so they work from any address and never create the user
+	readOnly := true
+	for _, line := range lines {
+		readOnly = readOnly && isReportCommand(line)
+	}
+
+	exercises, err = exercisesFromAddr(to)
+	if err != nil && !readOnly {
+		logEvent(r, "bad_parse", fmt.Sprintf("recipient not valid countmyreps address: %s - %v", to, err))
+		errMsgs = []string{fmt.Sprintf(ErrToAddrFmt, strings.Join(exerciseWords(), ", "), to)}
 		return
 	}
 
-	reps := strings.Split(subject, ",")
-	if len(reps) == 4 {
-		for i, rep := range reps {
-			count, err := strconv.Atoi(strings.TrimSpace(rep))
-			if err != nil {
-				logError(r, err, fmt.Sprintf("unable to convert %s to int", rep))
-				errMsg = fmt.Sprintf(ErrSubjectFmt, subject)
-				return
-			}
-			// protect against tricky people who spoof negative reps to other folks
-			if count < 0 {
-				count = -1 * count
-			}
-			var exercise string
-			switch i {
-			case 0:
-				exercise = PullUps
-			case 1:
-				exercise = PushUps
-			case 2:
-				exercise = Squats
-			case 3:
-				exercise = SitUps
-			default:
-				exercise = "unknown"
-			}
-			// TODO: move out of loop and use VALUES (), (), (), () and move to db.go
-			_, err = s.DB.Exec("INSERT INTO reps (exercise, count, user_id) VALUES (?, ?, ?)", exercise, count, userID)
-			if err != nil {
-				logError(r, err, "unable to insert rep")
-				errMsg = fmt.Sprintf(ErrUnexpectedFmt, "unable to insert into the database")
-				return
-			}
-		}
-	} else if inListCaseInsenitive(subject, Offices) {
-		// TODO: remove offices; just use teams
-		office := formattedOffice(subject)
-		// todo: move to db.go
-		_, err = s.DB.Exec("UPDATE user SET office=(SELECT id FROM office where name=?) WHERE id=? LIMIT 1", office, userID)
+	var userID int
+	if !readOnly {
+		userID, err = s.Store.GetOrCreateUserID(from)
 		if err != nil {
-			logError(r, err, "unable to update user's office")
-			errMsg = fmt.Sprintf(ErrUnexpectedFmt, "unable to update office relationship in the database")
-			return
-		}
-	} else if strings.Contains(strings.ToLower(subject), "team add:") {
-		parts := strings.Split(subject, ":")
-		if len(parts) < 2 {
-			logError(r, err, "enexpected error splitting subject for team add")
-			errMsg = fmt.Sprintf(ErrUnexpectedFmt, "unable to add to user teams")
-			return
-		}
-		err = addTeam(s.DB, sanitizeTeamName(parts[1]), userID)
-		if err != nil {
-			logError(r, err, "unable to add to user teams")
-			errMsg = fmt.Sprintf(ErrUnexpectedFmt, "unable to add to user teams")
-			return
-		}
-	} else if strings.Contains(strings.ToLower(subject), "team remove:") {
-		parts := strings.Split(subject, ":")
-		if len(parts) < 2 {
-			logError(r, err, "enexpected error splitting subject for team remove")
-			errMsg = fmt.Sprintf(ErrUnexpectedFmt, "unable to add to user teams")
-			return
+			logError(r, err, "unable to create/get user")
+			errMsgs = []string{fmt.Sprintf(ErrUnexpectedFmt, "unable to create and/or get user")}
+			return true
 		}
-		err = removeTeam(s.DB, sanitizeTeamName(parts[1]), userID)
-		if err != nil {
-			logError(r, err, "unable to remove from user teams")
-			errMsg = fmt.Sprintf(ErrUnexpectedFmt, "unable to remove from user teams")
-			return
+	}
+
+	msg.UserID = userID
+	msg.Exercises = exercises
+
+	var results []commandResult
+	for _, line := range lines {
+		result := s.runCommand(r, msg, line)
+		if result.Report != "" {
+			reports = append(reports, result.Report)
+			continue
 		}
-	} else {
-		logEvent(r, "bad_parse", fmt.Sprintf("bad subject: %s", subject))
-		errMsg = fmt.Sprintf(ErrSubjectFmt, subject)
+		results = append(results, result)
+		unexpected = unexpected || result.Unexpected
+	}
+	// with only reports, they are the whole reply
+	if len(results) == 0 {
+		skipReply = true
 		return
 	}
+	errMsgs, notices = summarizeResults(results)
+	return unexpected
 }
 
 func sanitizeTeamName(teamName string) string {
@@ -400,13 +583,27 @@ func sanitizeTeamName(teamName string) string {
 
 // ViewData is the data needed to populate the view.html template
 type ViewData struct {
+	Challenge  string
+	Challenges []string
+	Exercises  []string
 	UserEmail  string
 	UserOffice string
 	UserTeams  []string
 	TodaysReps []RepData
-	UserReps   []RepData
-	TeamReps   map[string][]RepData
-	TeamStats  map[string]Stats
+	// LastSubmission describes the user's most recent email of reps, ie, "Tue Nov 15 3:04PM: 6 Pull Ups, 2 Push Ups"
+	LastSubmission string
+	UserReps       []RepData
+	TeamReps       map[string][]RepData
+	TeamStats      map[string]Stats
+}
+
+// d3ChartData correctly formats []RepData to the JS format so data can display
+func d3ChartData(exercises []string, d []RepData) template.JS {
+	parts := make([]string, len(d))
+	for i, data := range d {
+		parts[i] = fmt.Sprintf("{State:'%s',freq:%s}", data.Date, d3Freq(data.ExerciseCounts, exercises))
+	}
+	return template.JS(strings.Join(parts, ",\n"))
 }
 
 // RepData is a single entry (or aggregate for a day)
@@ -434,9 +631,18 @@ func (s *Server) ViewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := s.getViewData(email)
+	c, err := s.challengeFromRequest(r)
+	if err == sql.ErrNoRows {
+		errorHandler(w, r, http.StatusNotFound, fmt.Sprintf("unknown challenge %q", r.URL.Query().Get("challenge")), err)
+		return
+	} else if err != nil {
+		errorHandler(w, r, http.StatusInternalServerError, "unable to get challenge", err)
+		return
+	}
+
+	data := s.getViewData(email, c)
 
-	err := ViewTemplate.Execute(w, data)
+	err = ViewTemplate.Execute(w, data)
 	if err != nil {
 		errorHandler(w, r, http.StatusInternalServerError, fmt.Sprintf("unable to execute %s template", "view.html"), err)
 		return
@@ -451,45 +657,77 @@ func (s *Server) JSONHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := s.getViewData(email)
+	c, err := s.challengeFromRequest(r)
+	if err == sql.ErrNoRows {
+		errorHandler(w, r, http.StatusNotFound, fmt.Sprintf("unknown challenge %q", r.URL.Query().Get("challenge")), err)
+		return
+	} else if err != nil {
+		errorHandler(w, r, http.StatusInternalServerError, "unable to get challenge", err)
+		return
+	}
+
+	data := s.getViewData(email, c)
 
 	w.Header().Set("content-type", "application/json")
-	err := json.NewEncoder(w).Encode(data)
+	err = json.NewEncoder(w).Encode(data)
 	if err != nil {
 		errorHandler(w, r, http.StatusInternalServerError, "unable to encode json", err)
 	}
 }
 
-func (s *Server) getViewData(email string) ViewData {
-	// TODO: clean up this hack by migrating user offices to user be one of their teams
-	officeAndTeamReps := getTeamReps(s.DB)
-	for k, v := range getOfficeReps(s.DB) {
-		officeAndTeamReps[k] = v
+// challengeFromRequest uses the challenge query parameter, defaulting to the current challenge
+func (s *Server) challengeFromRequest(r *http.Request) (Challenge, error) {
+	name := r.URL.Query().Get("challenge")
+	if name != "" {
+		return s.Store.GetChallenge(name)
 	}
-	officeAndTeamStats := getTeamStats(s.DB)
-	for k, v := range getOfficeStats(s.DB) {
-		officeAndTeamStats[k] = v
+	c, err := s.Store.GetCurrentChallenge(time.Now())
+	if err == sql.ErrNoRows {
+		// no challenges set up yet; show the empty view
+		return Challenge{}, nil
+	}
+	return c, err
+}
+
+func (s *Server) getViewData(email string, c Challenge) ViewData {
+	var challengeNames []string
+	challenges, err := s.Store.GetChallenges()
+	if err != nil {
+		logError(nil, err, "unable to get challenges")
+	}
+	for _, challenge := range challenges {
+		challengeNames = append(challengeNames, challenge.Name)
 	}
 
 	data := ViewData{
+		Challenge:  c.Name,
+		Challenges: challengeNames,
+		Exercises:  c.ExerciseNames(),
 		UserEmail:  email,
-		TodaysReps: getTodaysReps(s.DB, email),
-		UserOffice: getUserOffice(s.DB, email),
-		UserTeams:  getUserTeams(s.DB, email),
-		TeamReps:   officeAndTeamReps,
-		TeamStats:  officeAndTeamStats,
-		UserReps:   getUserReps(s.DB, email),
+		TodaysReps: s.Store.GetTodaysReps(email),
+		UserOffice: s.Store.GetUserOffice(email),
+		UserTeams:  s.Store.GetUserTeams(email),
+		TeamReps:   s.Store.GetTeamReps(c),
+		TeamStats:  s.Store.GetTeamStats(c),
+		UserReps:   s.Store.GetUserReps(c, email),
+	}
+
+	sub, err := s.Store.GetLastSubmission(email)
+	if err == nil {
+		data.LastSubmission = fmt.Sprintf("%s: %s", sub.ReceivedAt.In(s.Store.GetUserLocation(email)).Format("Mon Jan 2 3:04PM"), sub.summary())
+	} else if err != sql.ErrNoRows {
+		logError(nil, err, "unable to get last submission")
 	}
 	return data
 }
 
 // HeathcheckHandler verifies dependencies and reports if they are not in a good state
 func (s *Server) HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := s.DB.Exec("SELECT 1")
+	err := s.Store.Ping()
 	if err != nil {
 		logError(r, err, "healthcheck failed to query db")
-		w.Write([]byte("database issues\n"))
 		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("database issues\n"))
 	} else {
 		w.Write([]byte("database ok\n"))
 	}
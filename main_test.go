@@ -1,8 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/sethgrid/countmyreps/migrations"
 )
 
 func TestExtractEmailAddr(t *testing.T) {
@@ -21,6 +39,674 @@ func TestExtractEmailAddr(t *testing.T) {
 	}
 }
 
+func TestSenderList(t *testing.T) {
+	var senders SenderList
+	err := senders.Set(" SendGrid.com, *.example.org ,boss@partner.io,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"someone@sendgrid.com", true},
+		{"Some One <Someone@SENDGRID.COM>", true},
+		{"someone@mail.sendgrid.com", false},
+		{"someone@sendgrid.com.evil.com", false},
+		{"someone@notsendgrid.com", false},
+		{"someone@eu.example.org", true},
+		{"someone@a.b.example.org", true},
+		{"someone@example.org", false},
+		{"someone@badexample.org", false},
+		{"boss@partner.io", true},
+		{"intern@partner.io", false},
+		{"sendgrid.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got, want := senders.Allows(test.addr), test.allowed; got != want {
+			t.Errorf("got %t, want %t for %q", got, want, test.addr)
+		}
+	}
+
+	if err := senders.Set("*"); err != nil || !senders.Allows("anyone@anywhere.net") {
+		t.Errorf("got %v, want * to allow anyone", err)
+	}
+	for _, bad := range []string{"*sendgrid.com", "mail.*.com", "*.", "@sendgrid.com", "someone@"} {
+		if err := senders.Set(bad); err == nil {
+			t.Errorf("got no error for %q", bad)
+		}
+	}
+}
+
+func TestVerifySender(t *testing.T) {
+	defer func(spf, dkim bool) { RequireSPF, RequireDKIM = spf, dkim }(RequireSPF, RequireDKIM)
+
+	tests := []struct {
+		requireSPF  bool
+		requireDKIM bool
+		from        string
+		spf         string
+		dkim        string
+		ok          bool
+	}{
+		{false, false, "someone@sendgrid.com", "", "", true},
+		{true, false, "someone@sendgrid.com", "pass", "", true},
+		{true, false, "someone@sendgrid.com", "softfail", "", false},
+		{true, false, "someone@sendgrid.com", "", "", false},
+		{false, true, "Some One <someone@sendgrid.com>", "", "{@sendgrid.com : pass}", true},
+		{false, true, "someone@mail.sendgrid.com", "", "{@sendgrid.com : pass}", true},
+		{false, true, "someone@sendgrid.com", "", "{@other.com : pass, @sendgrid.com : fail}", false},
+		{false, true, "someone@sendgrid.com", "", "{@other.com : pass, @sendgrid.com : pass}", true},
+		{false, true, "someone@notsendgrid.com", "", "{@sendgrid.com : pass}", false},
+		{false, true, "someone@sendgrid.com", "", "none", false},
+		{true, true, "someone@sendgrid.com", "pass", "{@sendgrid.com : pass}", true},
+	}
+	for _, test := range tests {
+		RequireSPF, RequireDKIM = test.requireSPF, test.requireDKIM
+		if err := verifySender(test.from, test.spf, test.dkim); (err == nil) != test.ok {
+			t.Errorf("got %v, want ok %t for %+v", err, test.ok, test)
+		}
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	defer func(token, secret string) { ParseToken, ParseHMACSecret = token, secret }(ParseToken, ParseHMACSecret)
+	ParseToken, ParseHMACSecret = "s3cret", "shh"
+
+	body := "to=pullups%40countmyreps.com&subject=5"
+	mac := hmac.New(sha256.New, []byte("shh"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		url       string
+		signature string
+		ok        bool
+	}{
+		{"/parseapi/index.php?token=s3cret", signature, true},
+		{"/parseapi/index.php?token=s3cret", "sha256=" + signature, true},
+		{"/parseapi/index.php", signature, false},
+		{"/parseapi/index.php?token=wrong", signature, false},
+		{"/parseapi/index.php?token=s3cret", "", false},
+		{"/parseapi/index.php?token=s3cret", "not hex", false},
+		{"/parseapi/index.php?token=s3cret", strings.Repeat("0", len(signature)), false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", test.url, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set(SignatureHeader, test.signature)
+		err := verifyWebhook(httptest.NewRecorder(), r)
+		if (err == nil) != test.ok {
+			t.Errorf("got %v, want ok %t for %s with signature %q", err, test.ok, test.url, test.signature)
+		}
+		// the form is still readable after the body was checked
+		if err == nil && r.PostFormValue("subject") != "5" {
+			t.Errorf("got subject %q after verifying, want 5", r.PostFormValue("subject"))
+		}
+	}
+
+	// a body over MaxInboundSize is refused before it is all read
+	defer func(size int64) { MaxInboundSize = size }(MaxInboundSize)
+	MaxInboundSize = int64(len(body)) - 1
+	r := httptest.NewRequest("POST", "/parseapi/index.php?token=s3cret", strings.NewReader(body))
+	r.Header.Set(SignatureHeader, signature)
+	if err := verifyWebhook(httptest.NewRecorder(), r); err != errInboundTooLarge {
+		t.Errorf("got %v, want %v", err, errInboundTooLarge)
+	}
+}
+
+func TestParseRawEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		from    string
+		subject string
+		text    string
+	}{
+		{
+			name:    "plain",
+			raw:     "From: Some One <someone@sendgrid.com>\r\nTo: pullups-pushups@countmyreps.com\r\nSubject: 5, 10\r\nMessage-ID: <plain@mail.example.com>\r\n\r\nTeam Add: crossfit\r\n",
+			from:    "Some One <someone@sendgrid.com>",
+			subject: "5, 10",
+			text:    "Team Add: crossfit\r\n",
+		},
+		{
+			name:    "encoded words",
+			raw:     "From: =?UTF-8?B?Sm9zw6k=?= <jose@sendgrid.com>\nTo: pullups@countmyreps.com\nSubject: =?ISO-8859-1?Q?Team_Add:_caf=E9?=\n\n",
+			from:    "José <jose@sendgrid.com>",
+			subject: "Team Add: café",
+			text:    "",
+		},
+		{
+			name: "multipart with a quoted-printable iso-8859-1 part",
+			raw: "From: someone@sendgrid.com\nTo: pullups@countmyreps.com\nSubject: Re: reps\nContent-Type: multipart/alternative; boundary=XYZ\n\n" +
+				"--XYZ\nContent-Type: text/plain; charset=iso-8859-1\nContent-Transfer-Encoding: quoted-printable\n\n5, 10 =B7 caf=E9 =\nline\n" +
+				"--XYZ\nContent-Type: text/html; charset=utf-8\n\n<p>ignored</p>\n--XYZ--\n",
+			from:    "someone@sendgrid.com",
+			subject: "Re: reps",
+			text:    "5, 10 · café line",
+		},
+		{
+			name: "html only, in base64, with an attachment first",
+			raw: "From: someone@sendgrid.com\nTo: pullups@countmyreps.com\nSubject: stats\nContent-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+				"--b1\nContent-Type: text/plain\nContent-Disposition: attachment; filename=notes.txt\n\nnot a command\n" +
+				"--b1\nContent-Type: text/html; charset=utf-8\nContent-Transfer-Encoding: base64\n\n" +
+				"PGh0bWw+PGhlYWQ+PHN0eWxlPnB7fTwvc3R5bGU+PC9oZWFkPjxib2R5PlRl\nYW0gQWRkOiBmaXQ8YnI+NSwgMTAgJmFtcDsgbW9yZTwvYm9keT48L2h0bWw+\n" +
+				"--b1--\n",
+			from:    "someone@sendgrid.com",
+			subject: "stats",
+			text:    "Team Add: fit\n5, 10 & more",
+		},
+	}
+	for _, test := range tests {
+		msg, err := parseRawEmail(test.raw)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got, want := msg.From, test.from; got != want {
+			t.Errorf("%s: got from %q, want %q", test.name, got, want)
+		}
+		if got, want := msg.Subject, test.subject; got != want {
+			t.Errorf("%s: got subject %q, want %q", test.name, got, want)
+		}
+		if got, want := strings.TrimSpace(msg.Text), strings.TrimSpace(test.text); got != want {
+			t.Errorf("%s: got text %q, want %q", test.name, got, want)
+		}
+	}
+
+	if _, err := parseRawEmail("not an email"); err == nil {
+		t.Error("got no error for a message without headers")
+	}
+	// an unknown charset is read as is
+	msg, err := parseRawEmail("From: someone@sendgrid.com\nSubject: 5, 10\nContent-Type: text/plain; charset=x-no-such-charset\n\n5, 10\n")
+	if err != nil || strings.TrimSpace(msg.Text) != "5, 10" {
+		t.Errorf("got %q, %v, want the body as is for an unknown charset", msg.Text, err)
+	}
+}
+
+func TestParseRawEmailWindows1252(t *testing.T) {
+	// as Outlook sends it, after an html part that can't be decoded
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "raw", "outlook-windows-1252.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := parseRawEmail(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.From, "Renée <oc_3@sendgrid.com>"; got != want {
+		t.Errorf("got from %q, want %q", got, want)
+	}
+	if got, want := msg.Subject, "Re: reps – café"; got != want {
+		t.Errorf("got subject %q, want %q", got, want)
+	}
+	if got, want := bodyLines(msg.Text), []string{"5, 10", "Thanks – Renée"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got body lines %q, want %q", got, want)
+	}
+}
+
+// inboundFixtures are real shaped webhook bodies from each provider in testdata/inbound, all oc_3 logging "5, 10" to situps-pullups
+var inboundFixtures = []struct {
+	adapter     InboundAdapter
+	path        string
+	fixture     string
+	contentType string
+	messageID   string
+}{
+	{SendGridAdapter{}, "/inbound/sendgrid", "sendgrid.txt", "multipart/form-data; boundary=xYzZY", "<sendgrid-fixture@mail.sendgrid.com>"},
+	{MailgunAdapter{}, "/inbound/mailgun", "mailgun.txt", "application/x-www-form-urlencoded", "<mailgun-fixture@mail.sendgrid.com>"},
+	{PostmarkAdapter{}, "/inbound/postmark", "postmark.json", "application/json", "<postmark-fixture@mail.sendgrid.com>"},
+	{JSONAdapter{}, "/inbound/json", "json.json", "application/json", "<json-fixture@mail.sendgrid.com>"},
+}
+
+func TestInboundAdapters(t *testing.T) {
+	defer func(spf, dkim bool) { RequireSPF, RequireDKIM = spf, dkim }(RequireSPF, RequireDKIM)
+
+	for _, test := range inboundFixtures {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "inbound", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", test.path, bytes.NewReader(body))
+		r.Header.Set("Content-Type", test.contentType)
+		msg, err := test.adapter.Parse(r)
+		if err != nil {
+			t.Errorf("%s: %v", test.fixture, err)
+			continue
+		}
+
+		if got, want := extractEmailAddr(msg.To), "situps-pullups@countmyreps.com"; got != want {
+			t.Errorf("%s: got to %q, want %q", test.fixture, got, want)
+		}
+		if got, want := extractEmailAddr(msg.From), "oc_3@sendgrid.com"; got != want {
+			t.Errorf("%s: got from %q, want %q", test.fixture, got, want)
+		}
+		if got, want := msg.MessageID, test.messageID; got != want {
+			t.Errorf("%s: got message id %q, want %q", test.fixture, got, want)
+		}
+		if lines := bodyLines(msg.Text); len(lines) == 0 || lines[0] != "5, 10" {
+			t.Errorf("%s: got body lines %q, want 5, 10 first", test.fixture, lines)
+		}
+		if msg.Source == "" {
+			t.Errorf("%s: got no source", test.fixture)
+		}
+
+		// SPF is reported by every provider here, and DKIM by all but Postmark
+		RequireSPF, RequireDKIM = true, test.fixture != "postmark.json"
+		if err := verifySender(msg.From, msg.SPF, msg.DKIM); err != nil {
+			t.Errorf("%s: got %v verifying SPF %q and DKIM %q", test.fixture, err, msg.SPF, msg.DKIM)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/inbound/json", strings.NewReader("{not json"))
+	if _, err := (JSONAdapter{}).Parse(r); err == nil {
+		t.Error("got no error for malformed json")
+	}
+}
+
+func TestSMTPPath(t *testing.T) {
+	tests := []struct {
+		arg    string
+		prefix string
+		addr   string
+		ok     bool
+	}{
+		{"FROM:<someone@sendgrid.com>", "FROM:", "someone@sendgrid.com", true},
+		{"from: <someone@sendgrid.com> SIZE=1024 BODY=8BITMIME", "FROM:", "someone@sendgrid.com", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"TO:<pullups@countmyreps.com>", "TO:", "pullups@countmyreps.com", true},
+		{"TO:pullups@countmyreps.com", "TO:", "", false},
+		{"FROM:<someone@sendgrid.com>", "TO:", "", false},
+		{"", "TO:", "", false},
+	}
+	for _, test := range tests {
+		addr, ok := smtpPath(test.arg, test.prefix)
+		if addr != test.addr || ok != test.ok {
+			t.Errorf("got %q, %t, want %q, %t for %q", addr, ok, test.addr, test.ok, test.arg)
+		}
+	}
+}
+
+func TestSMTPEmailer(t *testing.T) {
+	// a local capture server stands in for the relay
+	type delivery struct{ from, rcpt, data string }
+	delivered := make(chan delivery, 1)
+	capture, err := listenSMTP("127.0.0.1", 0, []string{"sendgrid.com"}, func(from string, rcpt string, data string) bool {
+		delivered <- delivery{from, rcpt, data}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+	go capture.Serve()
+
+	emailer := SMTPEmailer{Host: "127.0.0.1", Port: capture.Port}
+	err = emailer.SendEmail("Oc Three <oc_3@sendgrid.com>", "Success! 💪", "Keep it up!\n\nYou've logged a total of 15 reps.", "<h3>Keep it up!</h3><p>You've logged a total of 15 reps.</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := <-delivered
+	if got, want := d.from, EmailFrom.Address; got != want {
+		t.Errorf("got envelope from %q, want %q", got, want)
+	}
+	if got, want := d.rcpt, "oc_3@sendgrid.com"; got != want {
+		t.Errorf("got envelope rcpt %q, want %q", got, want)
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(d.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject")); err != nil || subject != "Success! 💪" {
+		t.Errorf("got subject %q (%v), want it decoded", subject, err)
+	}
+	if got, want := m.Header.Get("To"), "<oc_3@sendgrid.com>"; got != want {
+		t.Errorf("got to %q, want %q", got, want)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got content type %q (%v), want multipart/alternative", mediaType, err)
+	}
+	// plain text first, so clients that show html prefer the last part
+	var parts []string
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		// NextPart decodes quoted-printable
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	want := []string{
+		"text/plain; charset=utf-8: Keep it up!\n\nYou've logged a total of 15 reps.",
+		"text/html; charset=utf-8: <h3>Keep it up!</h3><p>You've logged a total of 15 reps.</p>",
+	}
+	if got := strings.Join(parts, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("got parts %q, want %q", got, strings.Join(want, "\n"))
+	}
+
+	// the capture server has neither STARTTLS nor AUTH, so asking for them fails rather than sending in the clear
+	emailer.StartTLS = true
+	if err := emailer.SendEmail("oc_3@sendgrid.com", "Success!", "hi", "<p>hi</p>"); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("got %v, want a STARTTLS error", err)
+	}
+	emailer.StartTLS, emailer.Username, emailer.Password = false, "user", "pass"
+	if err := emailer.SendEmail("oc_3@sendgrid.com", "Success!", "hi", "<p>hi</p>"); err == nil || !strings.Contains(err.Error(), "authenticate") {
+		t.Errorf("got %v, want an auth error", err)
+	}
+	select {
+	case d := <-delivered:
+		t.Errorf("got a delivery to %s after a failed send", d.rcpt)
+	default:
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	defer func(backoff time.Duration) { OutboxBackoff = backoff }(OutboxBackoff)
+	OutboxBackoff = time.Minute
+
+	tests := []struct {
+		attempts int
+		wait     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{1000, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		if got, want := outboxBackoff(test.attempts), test.wait; got != want {
+			t.Errorf("got %s, want %s after %d attempts", got, want, test.attempts)
+		}
+	}
+}
+
+func TestRecordingEmailer(t *testing.T) {
+	rec := &RecordingEmailer{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec.SendEmail(fmt.Sprintf("user_%d@sendgrid.com", i%2), "Success!", fmt.Sprintf("Logged %d Sit Ups.", i), fmt.Sprintf("<p>Logged %d Sit Ups.</p>", i))
+		}(i)
+	}
+	wg.Wait()
+
+	if got, want := len(rec.Sent()), 20; got != want {
+		t.Errorf("got %d, want %d emails", got, want)
+	}
+	if got, want := len(rec.SentTo("User_1 <USER_1@sendgrid.com>")), 10; got != want {
+		t.Errorf("got %d, want %d emails to user_1, ignoring case and display name", got, want)
+	}
+	if _, ok := rec.Find("user_1@sendgrid.com", "Logged 7 Sit Ups."); !ok {
+		t.Error("did not find the email by its message")
+	}
+	if _, ok := rec.Find("user_0@sendgrid.com", "Logged 7 Sit Ups."); ok {
+		t.Error("found an email sent to someone else")
+	}
+
+	rec.Reset()
+	rec.Err = fmt.Errorf("provider is down")
+	if err := rec.SendEmail("user_0@sendgrid.com", "Success!", "", ""); err != rec.Err {
+		t.Errorf("got error %v, want %v", err, rec.Err)
+	}
+	if got, want := len(rec.Sent()), 1; got != want {
+		t.Errorf("got %d, want %d emails after Reset, including the failed one", got, want)
+	}
+}
+
+func TestEmailTemplates(t *testing.T) {
+	defer func(emailer Emailer, siteURL string) { EmailSender, SiteURL = emailer, siteURL }(EmailSender, SiteURL)
+	rec := &RecordingEmailer{}
+	EmailSender, SiteURL = rec, "https://reps.example.com/"
+
+	// every email has both parts
+	for _, tmpl := range EmailHTMLTemplates.Templates() {
+		name := strings.TrimSuffix(tmpl.Name(), ".html")
+		if name == tmpl.Name() || name == "header" {
+			continue
+		}
+		if EmailTextTemplates.Lookup(name+".txt") == nil {
+			t.Errorf("%s.html has no %s.txt", name, name)
+		}
+	}
+
+	err := sendTemplateEmail("oc_3@sendgrid.com", "Success!", "success", successEmail{
+		Notices: []string{`"Team Add: <script>": You are on the <script> team.`},
+		Teams:   []string{"R&D"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendTemplateEmail("oc_3@sendgrid.com", "Error with your submission", "error", errorEmail{
+		Subject: `<img src=x onerror="alert(1)">`,
+		Errors:  []string{`"<b>": one`, `"x": two`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := rec.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("got %d emails, want 2", len(sent))
+	}
+	for _, email := range sent {
+		if strings.Contains(email.HTML, "<script>") || strings.Contains(email.HTML, "<img src=x") {
+			t.Errorf("got unescaped user data in %s html:\n%s", email.Subject, email.HTML)
+		}
+		if !strings.Contains(email.HTML, `<img src="https://reps.example.com/images/mustache-thin.jpg"`) {
+			t.Errorf("got %s html without the header image from SiteURL:\n%s", email.Subject, email.HTML)
+		}
+		if strings.Contains(email.Text, "mustache") || strings.Contains(email.Text, "&lt;") {
+			t.Errorf("got html in the %s text:\n%s", email.Subject, email.Text)
+		}
+	}
+	for _, want := range []string{"&lt;script&gt;", "<li>R&amp;D</li>"} {
+		if !strings.Contains(sent[0].HTML, want) {
+			t.Errorf("got success html without %q:\n%s", want, sent[0].HTML)
+		}
+	}
+	if want := `* "Team Add: <script>": You are on the <script> team.`; !strings.Contains(sent[0].Text, want) {
+		t.Errorf("got success text without %q:\n%s", want, sent[0].Text)
+	}
+	if want := `Subject: <img src=x onerror="alert(1)">`; !strings.Contains(sent[1].Text, want) {
+		t.Errorf("got error text without %q:\n%s", want, sent[1].Text)
+	}
+	// each failure is its own line, escaped once
+	if want := "Error: &#34;&lt;b&gt;&#34;: one<br />\nError: &#34;x&#34;: two<br />"; !strings.Contains(sent[1].HTML, want) {
+		t.Errorf("got error html without %q:\n%s", want, sent[1].HTML)
+	}
+	if want := "Error: \"<b>\": one\nError: \"x\": two"; !strings.Contains(sent[1].Text, want) {
+		t.Errorf("got error text without %q:\n%s", want, sent[1].Text)
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	tests := []struct {
+		in     string
+		digest string
+		err    bool
+	}{
+		{"daily", "daily", false},
+		{" Weekly ", "weekly", false},
+		{"weekly, daily", "daily,weekly", false},
+		{"daily and weekly", "daily,weekly", false},
+		{"both", "daily,weekly", false},
+		{"Off", "", false},
+		{"none", "", false},
+		{"", "", true},
+		{"hourly", "", true},
+		{"daily, off", "", true},
+	}
+	for _, test := range tests {
+		digest, err := parseDigest(test.in)
+		if digest != test.digest || (err != nil) != test.err {
+			t.Errorf("%q: got %q and error %v, want %q and error %t", test.in, digest, err, test.digest, test.err)
+		}
+	}
+	if u := (DigestUser{Digest: "daily,weekly"}); !u.wants(DigestDaily) || !u.wants(DigestWeekly) {
+		t.Error("got a user missing a digest they opted in to")
+	}
+	if u := (DigestUser{Digest: "weekly"}); u.wants(DigestDaily) {
+		t.Error("got a user with a digest they did not opt in to")
+	}
+}
+
+func TestRankTeams(t *testing.T) {
+	got := rankTeams(map[string]Stats{
+		"OC":       {TotalReps: 50},
+		"crossfit": {TotalReps: 80},
+		"Boulder":  {TotalReps: 50},
+		"runners":  {TotalReps: 10},
+	})
+	var lines []string
+	for _, total := range got {
+		lines = append(lines, fmt.Sprintf("#%d %s %d", total.Rank, total.Team, total.Total))
+	}
+	// ties share a rank, in name order
+	if got, want := strings.Join(lines, ", "), "#1 crossfit 80, #2 Boulder 50, #2 OC 50, #4 runners 10"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMessageIDFromHeaders(t *testing.T) {
+	tests := []struct {
+		headers   string
+		messageID string
+	}{
+		{"", ""},
+		{"Subject: 1, 2, 3, 4\nMessage-ID: <abc123@mail.example.com>\nTo: pullups@countmyreps.com\n", "<abc123@mail.example.com>"},
+		{"Message-Id:\r\n <folded@mail.example.com>\r\nFrom: someone@sendgrid.com", "<folded@mail.example.com>"},
+		{"From: someone@sendgrid.com\n", ""},
+	}
+	for _, test := range tests {
+		if got, want := messageIDFromHeaders(test.headers), test.messageID; got != want {
+			t.Errorf("got %q, want %q for %q", got, want, test.headers)
+		}
+	}
+}
+
+func TestCreditDay(t *testing.T) {
+	loc, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday, Nov 11 2016 at 9PM in Denver is already Saturday in UTC
+	now := time.Date(2016, 11, 12, 4, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		subject  string
+		ok       bool
+		credited string
+		err      bool
+	}{
+		{"5, 10, 15, 20", false, "", false},
+		{"Team Add: 5", false, "", false},
+		{"Timezone: America/Denver", false, "", false},
+		{"today: 5, 10, 15, 20", true, "2016-11-11", false},
+		{"Yesterday: 5,10,15,20", true, "2016-11-10", false},
+		{"2016-11-04: 5, 10, 15, 20", true, "2016-11-04", false},
+		{"2016-11-03: 5, 10, 15, 20", true, "", true}, // more than BackdateDays
+		{"2016-11-12: 5, 10, 15, 20", true, "", true}, // tomorrow in Denver
+		{"2016-13-01: 5, 10, 15, 20", true, "", true},
+		{"11/04: 5, 10, 15, 20", true, "", true},
+	}
+	for _, test := range tests {
+		day, _, ok := splitDatePrefix(test.subject)
+		if got, want := ok, test.ok; got != want {
+			t.Errorf("%q: got ok %t, want %t", test.subject, got, want)
+		}
+		if !ok {
+			continue
+		}
+		credited, err := creditDay(day, now, loc)
+		if got, want := err != nil, test.err; got != want {
+			t.Errorf("%q: got error %v, want error %t", test.subject, err, want)
+			continue
+		}
+		if err == nil && credited.Format("2006-01-02") != test.credited {
+			t.Errorf("%q: got %s, want %s", test.subject, credited.Format("2006-01-02"), test.credited)
+		}
+	}
+}
+
+func TestBodyLines(t *testing.T) {
+	tests := []struct {
+		text  string
+		lines []string
+	}{
+		{"", nil},
+		{"Team Add: crossfit\r\n\r\n  5, 10  \r\n", []string{"Team Add: crossfit", "5, 10"}},
+		{"5, 10\n-- \nJohn Smith\n10, 20", []string{"5, 10"}},
+		{"5, 10\n\nOn Tue, Nov 1, 2016 at 9:00 AM, CountMyReps <automailer@countmyreps.com> wrote:\n> Keep it up!", []string{"5, 10"}},
+		{"5, 10\n> 20, 20", []string{"5, 10"}},
+		{"undo\nSent from my iPhone", []string{"undo"}},
+		{"undo\n-----Original Message-----\nFrom: someone", []string{"undo"}},
+	}
+	for _, test := range tests {
+		if got, want := strings.Join(bodyLines(test.text), "|"), strings.Join(test.lines, "|"); got != want {
+			t.Errorf("got %q, want %q for %q", got, want, test.text)
+		}
+	}
+}
+
+func TestSubjectErrMsg(t *testing.T) {
+	tests := []struct {
+		exercises []string
+		want      string
+	}{
+		{
+			[]string{"Pull Ups", "Push Ups", "Squats", "Sit Ups"},
+			"provide 4 comma separated numbers like: `5, 10, 15, 20` where the numbers represent pull ups, push ups, squats, and sit ups respectively, or name the exercises like: `10 pullups, 20 pushups`. You provided \"five\"",
+		},
+		{
+			[]string{"Burpees", "Squats"},
+			"provide 2 comma separated numbers like: `5, 10` where the numbers represent burpees and squats respectively, or name the exercises like: `10 burpees, 20 squats`. You provided \"five\"",
+		},
+	}
+	for _, test := range tests {
+		if got := subjectErrMsg(test.exercises, "five"); !strings.Contains(got, test.want) {
+			t.Errorf("got %q, want it to contain %q", got, test.want)
+		}
+	}
+}
+
+func TestSummarizeResults(t *testing.T) {
+	// a single command reads as it always has
+	failures, notices := summarizeResults([]commandResult{{Line: "5, 10", ErrMsg: "bad"}})
+	if strings.Join(failures, "|") != "bad" || len(notices) != 0 {
+		t.Errorf("got %q %v for a single failure", failures, notices)
+	}
+
+	// a mix is a success, with a notice per line
+	failures, notices = summarizeResults([]commandResult{{Line: "5, 10", Notice: "Logged 5 Sit Ups, 10 Pull Ups."}, {Line: "Timezone: Mars", ErrMsg: "bad timezone"}})
+	if len(failures) != 0 {
+		t.Errorf("got errors %q, want success when any command worked", failures)
+	}
+	if got, want := strings.Join(notices, "|"), `"5, 10": Logged 5 Sit Ups, 10 Pull Ups.|"Timezone: Mars": bad timezone`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// all failures are an error listing each line, left for the template to escape
+	failures, _ = summarizeResults([]commandResult{{Line: "<b>", ErrMsg: "one"}, {Line: "x", ErrMsg: "two"}})
+	if got, want := strings.Join(failures, "|"), `"<b>": one|"x": two`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestOfficeComparisonUpdateLeading(t *testing.T) {
 	stats := fakeStats()
 	msg := officeComparisonUpdate("RWC", stats)
@@ -98,6 +784,278 @@ func TestSanitizeTeamName(t *testing.T) {
 	}
 }
 
+func TestExercisesFromAddr(t *testing.T) {
+	Exercises = fakeExercises()
+	tests := []struct {
+		to        string
+		exercises []string
+		err       bool
+	}{
+		{NewEmail, []string{"Pull Ups", "Push Ups", "Squats", "Sit Ups"}, false},
+		{OldEmail, []string{"Pull Ups", "Push Ups", "Squats", "Sit Ups"}, false},
+		{"Count My Reps <SitUps-PullUps@countmyreps.com>", []string{"Sit Ups", "Pull Ups"}, false},
+		{"squats@countmyreps.com", []string{"Squats"}, false},
+		{"situps-burpees@countmyreps.com", nil, true},
+		{"situps-situps@countmyreps.com", nil, true},
+		{"situps-pullups@example.com", nil, true},
+		{"@countmyreps.com", nil, true},
+	}
+	for _, test := range tests {
+		exercises, err := exercisesFromAddr(test.to)
+		if got, want := err != nil, test.err; got != want {
+			t.Errorf("got error %v, want error %t for %s", err, want, test.to)
+		}
+		if got, want := strings.Join(exercises, ","), strings.Join(test.exercises, ","); got != want {
+			t.Errorf("got %s, want %s for %s", got, want, test.to)
+		}
+	}
+}
+
+func TestParseRepCounts(t *testing.T) {
+	Exercises = fakeExercises()
+	counts, err := parseRepCounts("5, -10", []string{"Sit Ups", "Pull Ups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := counts["Sit Ups"], 5; got != want {
+		t.Errorf("got %d, want %d sit ups", got, want)
+	}
+	if got, want := counts["Pull Ups"], 10; got != want {
+		t.Errorf("got %d, want %d pull ups", got, want)
+	}
+
+	if _, err := parseRepCounts("5, 10, 15", []string{"Sit Ups", "Pull Ups"}); err == nil {
+		t.Error("got no error, want error for too many numbers")
+	}
+	if !isRepSubject("5, 10, 15") {
+		t.Error("got false, want true for isRepSubject")
+	}
+	if isRepSubject("Team Add: eng") {
+		t.Error("got true, want false for isRepSubject")
+	}
+}
+
+func TestParseNamedRepCounts(t *testing.T) {
+	Exercises = fakeExercises()
+	tests := []struct {
+		subject   string
+		named     bool
+		exercises string
+		counts    string
+		err       string
+	}{
+		{"5, 10, 15, 20", false, "", "", ""},
+		{"OC", false, "", "", ""},
+		{"Team Add: 5k runners", false, "", "", ""},
+		{"pushups 20, squats 30", true, "Push Ups,Squats", "20,30", ""},
+		{"20 pushups", true, "Push Ups", "20", ""},
+		{" Air Squats 15 , 10 Pull Ups ", true, "Squats,Pull Ups", "15,10", ""},
+		{"situp -5", true, "Sit Ups", "5", ""},
+		{"pushups 20, burpes 10", true, "", "", `the exercise "burpes"`},
+		{"pushups twenty", true, "", "", `"twenty" as a number`},
+		{"pushups", true, "", "", `a count for "pushups"`},
+		{"pushups 20, 30", true, "", "", `"30" without an exercise`},
+		{"pushups 20, pushup 5", true, "", "", `"pushup 5", because Push Ups is listed more than once`},
+	}
+	for _, test := range tests {
+		if got, want := isNamedRepSubject(test.subject), test.named; got != want {
+			t.Errorf("%q: got named %t, want %t", test.subject, got, want)
+		}
+		if !test.named {
+			continue
+		}
+		exercises, counts, err := parseNamedRepCounts(test.subject)
+		var errStr string
+		if err != nil {
+			errStr = err.Error()
+		}
+		if got, want := errStr, test.err; got != want {
+			t.Errorf("%q: got error %q, want %q", test.subject, got, want)
+		}
+		var countStrs []string
+		for _, exercise := range exercises {
+			countStrs = append(countStrs, fmt.Sprint(counts[exercise]))
+		}
+		if got, want := strings.Join(exercises, ","), test.exercises; got != want {
+			t.Errorf("%q: got exercises %s, want %s", test.subject, got, want)
+		}
+		if got, want := strings.Join(countStrs, ","), test.counts; got != want {
+			t.Errorf("%q: got counts %s, want %s", test.subject, got, want)
+		}
+	}
+}
+
+func TestD3Freq(t *testing.T) {
+	Exercises = fakeExercises()
+	if got, want := d3Freq(map[string]int{"Squats": 3, "Burpees": 1}, exerciseNames()), `{"Pull Ups":0,"Push Ups":0,"Sit Ups":0,"Squats":3}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	Exercises = append(Exercises, Exercise{Name: "Burpees", DisplayOrder: 5, Active: true})
+	if got, want := d3Freq(map[string]int{"Squats": 3, "Burpees": 1}, exerciseNames()), `{"Burpees":1,"Pull Ups":0,"Push Ups":0,"Sit Ups":0,"Squats":3}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, ok := exerciseByWord("burpees"); !ok {
+		t.Error("got false, want burpees to be a valid exercise")
+	}
+
+	// a challenge can limit the exercises shown
+	c := Challenge{Exercises: []string{"Squats", "Burpees"}}
+	if got, want := d3Freq(map[string]int{"Squats": 3, "Sit Ups": 1}, c.ExerciseNames()), `{"Burpees":0,"Squats":3}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	Exercises = fakeExercises()
+	start, _ := time.Parse("2006-01-02", "2016-11-01")
+	end, _ := time.Parse("2006-01-02", "2016-11-30")
+	c := Challenge{Name: "Movember 2016", StartDate: start, EndDate: end}
+
+	if !c.HasExercise("Pull Ups") {
+		t.Error("got false, want every active exercise in a challenge without exercises")
+	}
+	if !c.HasTeam("eng") {
+		t.Error("got false, want every team in a challenge without teams")
+	}
+	c.Exercises = []string{"Squats"}
+	c.Teams = []string{"sales"}
+	if c.HasExercise("Pull Ups") {
+		t.Error("got true, want false for an exercise not in the challenge")
+	}
+	if c.HasTeam("eng") {
+		t.Error("got true, want false for a team not in the challenge")
+	}
+
+	for _, test := range []struct {
+		day    string
+		active bool
+	}{
+		{"2016-10-31", false},
+		{"2016-11-01", true},
+		{"2016-11-30", true},
+		{"2016-12-01", false},
+	} {
+		day, _ := time.Parse("2006-01-02", test.day)
+		if got, want := c.IsActive(day.Add(12*time.Hour)), test.active; got != want {
+			t.Errorf("got %t, want %t for %s", got, want, test.day)
+		}
+	}
+}
+
+func TestTimezoneBuckets(t *testing.T) {
+	la := loadLocation("America/Los_Angeles")
+	london := loadLocation("Europe/London")
+
+	// 2016-11-06 is when LA falls back from PDT to PST; midnight was still PDT (UTC-7)
+	afternoon := time.Date(2016, 11, 6, 23, 0, 0, 0, time.UTC) // 3pm PST
+	if got, want := startOfDay(afternoon, la), time.Date(2016, 11, 6, 7, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %v, want %v for start of day across DST", got.UTC(), want)
+	}
+
+	// late on Nov 1 in LA is already Nov 2 in London
+	lateNight := time.Date(2016, 11, 2, 6, 30, 0, 0, time.UTC)
+	if got, want := dayKey(lateNight, la), "11-1"; got != want {
+		t.Errorf("got %s, want %s for LA bucket", got, want)
+	}
+	if got, want := dayKey(lateNight, london), "11-2"; got != want {
+		t.Errorf("got %s, want %s for London bucket", got, want)
+	}
+
+	if got, want := loadLocation("Not/AZone").String(), DefaultTimezone; got != want {
+		t.Errorf("got %s, want %s for a bad timezone", got, want)
+	}
+	if validTimezone("Not/AZone") || validTimezone("") || !validTimezone("America/Denver") {
+		t.Error("unexpected result from validTimezone")
+	}
+}
+
+func TestChallengeDaysElapsed(t *testing.T) {
+	la := loadLocation("America/Los_Angeles")
+	start, _ := time.Parse("2006-01-02", "2016-11-01")
+	end, _ := time.Parse("2006-01-02", "2016-11-30")
+	c := Challenge{StartDate: start, EndDate: end}
+
+	for _, test := range []struct {
+		now  time.Time
+		days int
+	}{
+		{time.Date(2016, 10, 31, 12, 0, 0, 0, la), 0},
+		{time.Date(2016, 11, 1, 0, 0, 0, 0, la), 1},
+		{time.Date(2016, 11, 6, 23, 0, 0, 0, la), 6},
+		{time.Date(2016, 11, 7, 1, 0, 0, 0, la), 7}, // the day after the 25 hour day
+		{time.Date(2016, 12, 15, 1, 0, 0, 0, la), 30},
+	} {
+		if got, want := c.daysElapsed(test.now, la), test.days; got != want {
+			t.Errorf("got %d, want %d days elapsed at %v", got, want, test.now)
+		}
+	}
+}
+
+func TestChallengeDaysRemaining(t *testing.T) {
+	loc, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Challenge{StartDate: time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2016, 11, 30, 0, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		now  time.Time
+		days int
+	}{
+		{time.Date(2016, 10, 20, 12, 0, 0, 0, loc), 30},
+		{time.Date(2016, 11, 1, 0, 0, 0, 0, loc), 30},
+		{time.Date(2016, 11, 28, 23, 0, 0, 0, loc), 3},
+		// already Dec 1 in UTC, still the last day in Denver
+		{time.Date(2016, 11, 30, 22, 0, 0, 0, loc), 1},
+		{time.Date(2016, 12, 1, 0, 0, 0, 0, loc), 0},
+	}
+	for _, test := range tests {
+		if got, want := c.daysRemaining(test.now, loc), test.days; got != want {
+			t.Errorf("got %d, want %d days remaining at %s", got, want, test.now)
+		}
+	}
+}
+
+// pingStore is a Store that only knows how to Ping; any other call panics
+type pingStore struct {
+	Store
+	err error
+}
+
+func (p pingStore) Ping() error {
+	return p.err
+}
+
+func TestHealthcheckHandler(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code int
+		body string
+	}{
+		{nil, http.StatusOK, "database ok"},
+		{fmt.Errorf("no db"), http.StatusServiceUnavailable, "database issues"},
+	} {
+		s := NewServer(pingStore{err: test.err}, 0, FakeEmailer{})
+		w := httptest.NewRecorder()
+		s.HealthcheckHandler(w, httptest.NewRequest("GET", "/healthcheck", nil))
+		if got, want := w.Code, test.code; got != want {
+			t.Errorf("got %d, want %d for ping error %v", got, want, test.err)
+		}
+		if !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("got %q, want %q for ping error %v", w.Body.String(), test.body, test.err)
+		}
+	}
+}
+
+func fakeExercises() []Exercise {
+	return []Exercise{
+		{ID: 1, Name: "Pull Ups", Aliases: []string{"pullup"}, DisplayOrder: 1, Active: true},
+		{ID: 2, Name: "Push Ups", Aliases: []string{"pushup"}, DisplayOrder: 2, Active: true},
+		{ID: 3, Name: "Squats", Aliases: []string{"squat", "airsquats", "airsquat"}, DisplayOrder: 3, Active: true},
+		{ID: 4, Name: "Sit Ups", Aliases: []string{"situp"}, DisplayOrder: 4, Active: true},
+	}
+}
+
 func fakeStats() map[string]Stats {
 	stats := make(map[string]Stats)
 
@@ -133,3 +1091,100 @@ func fakeStats() map[string]Stats {
 
 	return stats
 }
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("countmyreps_migrate_%d.db", time.Now().UnixNano()))
+	db := openSQLite(path)
+	defer os.Remove(path)
+	defer db.Close()
+
+	latest, err := migrations.Latest(migrations.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new database is behind and must be refused
+	if err := checkSchema(db, migrations.SQLite); err == nil || !strings.Contains(err.Error(), "migrate up") {
+		t.Errorf("got %v, want an error saying to migrate up", err)
+	}
+
+	// checking and listing only read, and leave the database as they found it
+	var out bytes.Buffer
+	if err := runMigrate(db, migrations.SQLite, []string{"status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(out.String(), "pending"), latest; got != want {
+		t.Errorf("got %d migrations pending, want %d:\n%s", got, want, out.String())
+	}
+	var tables int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table'").Scan(&tables); err != nil || tables != 0 {
+		t.Errorf("got %d tables and error %v after checking a new database, want none", tables, err)
+	}
+
+	out.Reset()
+	if err := runMigrate(db, migrations.SQLite, []string{"up"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(out.String(), "applied"), latest; got != want {
+		t.Errorf("got %d migrations applied, want %d:\n%s", got, want, out.String())
+	}
+	if err := checkSchema(db, migrations.SQLite); err != nil {
+		t.Errorf("got %v after migrating up", err)
+	}
+	if _, err := NewSQLiteStore(db).GetExercises(); err != nil {
+		t.Errorf("unable to query the migrated schema: %v", err)
+	}
+
+	out.Reset()
+	if err := runMigrate(db, migrations.SQLite, []string{"status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "pending") {
+		t.Errorf("got pending migrations after up:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runMigrate(db, migrations.SQLite, []string{"down"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "rolled back") {
+		t.Errorf("got %q, want a rolled back migration", out.String())
+	}
+	if err := checkSchema(db, migrations.SQLite); err == nil {
+		t.Error("got no error after migrating down")
+	}
+
+	if err := runMigrate(db, migrations.SQLite, []string{"sideways"}, &out); err == nil {
+		t.Error("got no error for an unknown migrate command")
+	}
+}
+
+func TestMigrateRefusesOldTables(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("countmyreps_baseline_%d.db", time.Now().UnixNano()))
+	db := openSQLite(path)
+	defer os.Remove(path)
+	defer db.Close()
+
+	// reps from before challenges, without challenge_id
+	_, err := db.Exec("CREATE TABLE `reps` (`id` INTEGER PRIMARY KEY AUTOINCREMENT, `user_id` INTEGER NOT NULL, `exercise` varchar(255) NOT NULL DEFAULT '', `count` INTEGER NOT NULL, `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = runMigrate(db, migrations.SQLite, []string{"up"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "reps.challenge_id") {
+		t.Errorf("got %v, want an error naming reps.challenge_id", err)
+	}
+	if current, err := migrations.Current(db); err != nil || current != 0 {
+		t.Errorf("got version %d (%v), want nothing recorded", current, err)
+	}
+
+	_, err = db.Exec("ALTER TABLE `reps` ADD COLUMN `challenge_id` INTEGER DEFAULT NULL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runMigrate(db, migrations.SQLite, []string{"up"}, &out); err != nil {
+		t.Errorf("got %v after adding the column", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/sethgrid/countmyreps/migrations"
+)
+
+// checkSchema refuses a database whose schema is behind the migrations built into this binary
+func checkSchema(db *sql.DB, dialect string) error {
+	pending, err := migrations.Pending(db, dialect)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		current, err := migrations.Current(db)
+		if err != nil {
+			return err
+		}
+		latest, err := migrations.Latest(dialect)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("database schema is at version %d and this binary needs version %d; run `%s migrate up`", current, latest, AppName)
+	}
+	return nil
+}
+
+// runMigrate is the migrate subcommand: up applies every pending migration, down rolls back the latest, and status lists them all
+func runMigrate(db *sql.DB, dialect string, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s migrate up|down|status", AppName)
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrations.Up(db, dialect)
+		for _, m := range done {
+			fmt.Fprintf(w, "applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(w, "already up to date")
+		}
+	case "down":
+		m, ok, err := migrations.Down(db, dialect)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(w, "nothing to roll back")
+			return nil
+		}
+		fmt.Fprintf(w, "rolled back %04d_%s\n", m.Version, m.Name)
+	case "status":
+		all, err := migrations.Load(dialect)
+		if err != nil {
+			return err
+		}
+		pending, err := migrations.Pending(db, dialect)
+		if err != nil {
+			return err
+		}
+		isPending := make(map[int]bool)
+		for _, m := range pending {
+			isPending[m.Version] = true
+		}
+		for _, m := range all {
+			state := "applied"
+			if isPending[m.Version] {
+				state = "pending"
+			}
+			fmt.Fprintf(w, "%-8s %04d_%s\n", state, m.Version, m.Name)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q; usage: %s migrate up|down|status", args[0], AppName)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+// Package migrations holds the versioned schema for each supported database and applies it.
+//
+// Each migration is a pair of files, NNNN_name.up.sql and NNNN_name.down.sql, in the directory for the
+// dialect (mysql/ or sqlite/). Statements are split on ";", so comments must not contain one.
+// Applied versions are recorded in the schema_migrations table.
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Dialects match the database/sql driver names
+const (
+	MySQL  = "mysql"
+	SQLite = "sqlite3"
+)
+
+//go:embed mysql/*.sql sqlite/*.sql
+var files embed.FS
+
+// Migration is a single schema version
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// dirs maps each dialect to its directory of migrations
+var dirs = map[string]string{
+	MySQL:  "mysql",
+	SQLite: "sqlite",
+}
+
+// Load reads the migrations for the dialect, ordered by version
+func Load(dialect string) ([]Migration, error) {
+	dir, ok := dirs[dialect]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for dialect %q", dialect)
+	}
+	entries, err := files.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s migrations", dialect)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		// 0001_create_tables.up.sql is version 1, named create_tables
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s is not named .up.sql or .down.sql", fileName)
+		}
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a version number and name", fileName)
+		}
+		body, err := files.ReadFile(path.Join(dir, fileName))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read migration %s", fileName)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		} else if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, parts[1])
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Latest is the version the dialect's migrations bring a database to
+func Latest(dialect string) (int, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// Applied lists the versions recorded in schema_migrations, in order. It only reads, so a database without
+// schema_migrations has none applied, and the table is left for Up to create.
+func Applied(db *sql.DB) ([]int, error) {
+	exists, err := tableExists(db)
+	if err != nil || !exists {
+		return nil, err
+	}
+	q := "SELECT version FROM schema_migrations ORDER BY version"
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query schema_migrations")
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		err = rows.Scan(&version)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to scan schema_migrations")
+		}
+		versions = append(versions, version)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return versions, nil
+}
+
+// Current is the highest applied version, or 0 for an empty database
+func Current(db *sql.DB) (int, error) {
+	versions, err := Applied(db)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Pending lists the migrations not yet applied, in the order they will be
+func Pending(db *sql.DB, dialect string) ([]Migration, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := Applied(db)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, version := range versions {
+		applied[version] = true
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration and returns the ones it applied
+func Up(db *sql.DB, dialect string) ([]Migration, error) {
+	err := ensureTable(db)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := Pending(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range pending {
+		err = execStatements(db, m.Up)
+		if m.Version == 1 {
+			// an older install's tables can fail version 1, or pass it while missing columns; either way, say which
+			if baselineErr := checkBaseline(db); baselineErr != nil {
+				return done, baselineErr
+			}
+		}
+		if err != nil {
+			return done, errors.Wrapf(err, "unable to apply migration %04d_%s", m.Version, m.Name)
+		}
+		_, err = db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+		if err != nil {
+			return done, errors.Wrapf(err, "unable to record migration %04d_%s", m.Version, m.Name)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Down rolls back the most recently applied migration. It returns false if nothing was applied.
+func Down(db *sql.DB, dialect string) (Migration, bool, error) {
+	current, err := Current(db)
+	if err != nil || current == 0 {
+		return Migration{}, false, err
+	}
+	migrations, err := Load(dialect)
+	if err != nil {
+		return Migration{}, false, err
+	}
+	for _, m := range migrations {
+		if m.Version != current {
+			continue
+		}
+		err = execStatements(db, m.Down)
+		if err != nil {
+			return m, false, errors.Wrapf(err, "unable to roll back migration %04d_%s", m.Version, m.Name)
+		}
+		_, err = db.Exec("DELETE FROM schema_migrations WHERE version=?", m.Version)
+		if err != nil {
+			return m, false, errors.Wrapf(err, "unable to unrecord migration %04d_%s", m.Version, m.Name)
+		}
+		return m, true, nil
+	}
+	return Migration{}, false, fmt.Errorf("database is at version %d, which this binary has no migration for", current)
+}
+
+// baselineColumns are the columns version 1 creates. Its CREATE TABLE IF NOT EXISTS statements skip a table an
+// older install already has, so one missing any of these columns is refused rather than recorded at version 1.
+var baselineColumns = map[string][]string{
+	"user":               {"id", "email", "timezone"},
+	"reps":               {"id", "user_id", "exercise", "count", "created_at", "challenge_id"},
+	"team":               {"id", "name", "kind", "head_count", "timezone"},
+	"user_team":          {"id", "user_id", "team_id"},
+	"exercise":           {"id", "name", "aliases", "display_order", "active"},
+	"challenge":          {"id", "name", "start_date", "end_date"},
+	"challenge_exercise": {"id", "challenge_id", "exercise_id"},
+	"challenge_team":     {"id", "challenge_id", "team_id"},
+}
+
+// checkBaseline returns an error listing any baselineColumns the database lacks
+func checkBaseline(db *sql.DB) error {
+	var tables []string
+	for table := range baselineColumns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	var missing []string
+	for _, table := range tables {
+		for _, column := range baselineColumns[table] {
+			// selecting no rows works in every dialect and only fails if the column is not there
+			rows, err := db.Query(fmt.Sprintf("SELECT `%s` FROM `%s` LIMIT 0", column, table))
+			if err != nil {
+				missing = append(missing, table+"."+column)
+				continue
+			}
+			rows.Close()
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("existing tables are missing %s; upgrade them with the scripts in setup/ (see the README) and run migrate up again", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// tableExists reports if schema_migrations is there, with the same LIMIT 0 probe as checkBaseline
+func tableExists(db *sql.DB) (bool, error) {
+	rows, err := db.Query("SELECT version FROM schema_migrations LIMIT 0")
+	if err == nil {
+		rows.Close()
+		return true, nil
+	}
+	// the probe fails the same way when the database can't be reached, so make sure it can
+	if pingErr := db.Ping(); pingErr != nil {
+		return false, errors.Wrap(pingErr, "unable to reach the database")
+	}
+	return false, nil
+}
+
+// ensureTable creates schema_migrations; the same statement works for every dialect
+func ensureTable(db *sql.DB) error {
+	q := "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY, name varchar(255) NOT NULL DEFAULT '', applied_at timestamp NULL DEFAULT CURRENT_TIMESTAMP)"
+	_, err := db.Exec(q)
+	if err != nil {
+		return errors.Wrap(err, "unable to create schema_migrations")
+	}
+	return nil
+}
+
+// execStatements runs each ";" separated statement. DDL is not transactional in MySQL, so neither is this.
+func execStatements(db *sql.DB, body string) error {
+	for _, statement := range strings.Split(body, ";") {
+		statement = strings.TrimSpace(statement)
+		if statement == "" || isComment(statement) {
+			continue
+		}
+		_, err := db.Exec(statement)
+		if err != nil {
+			return errors.Wrapf(err, "error running %s", statement)
+		}
+	}
+	return nil
+}
+
+// isComment reports if every line of the statement is a -- comment
+func isComment(statement string) bool {
+	for _, line := range strings.Split(statement, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"testing"
+)
+
+func TestDialectsMatch(t *testing.T) {
+	mysql, err := Load(MySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := Load(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mysql) == 0 {
+		t.Fatal("no migrations")
+	}
+	if got, want := len(sqlite), len(mysql); got != want {
+		t.Fatalf("got %d sqlite migrations, want %d to match mysql", got, want)
+	}
+	for i := range mysql {
+		if got, want := sqlite[i].Version, mysql[i].Version; got != want {
+			t.Errorf("migration %d: got sqlite version %d, want %d", i, got, want)
+		}
+		if got, want := sqlite[i].Name, mysql[i].Name; got != want {
+			t.Errorf("migration %d: got sqlite name %q, want %q", i, got, want)
+		}
+	}
+}
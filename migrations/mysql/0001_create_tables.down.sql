@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS `challenge_team`;
+DROP TABLE IF EXISTS `challenge_exercise`;
+DROP TABLE IF EXISTS `challenge`;
+DROP TABLE IF EXISTS `exercise`;
+DROP TABLE IF EXISTS `user_team`;
+DROP TABLE IF EXISTS `team`;
+DROP TABLE IF EXISTS `reps`;
+DROP TABLE IF EXISTS `user`;
@@ -0,0 +1,101 @@
+-- The schema as of create_db_v2.sql. Tables that already exist are skipped, not altered, so an existing install
+-- is only recorded at version 1 if its tables have every column below (migrate up checks and refuses otherwise).
+-- Older installs bring them up to date with setup/migrate_offices_to_teams.sql, setup/add_timezones.sql,
+-- and setup/add_challenges.sql first.
+
+-- Create syntax for TABLE 'user'
+CREATE TABLE IF NOT EXISTS `user` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `email` varchar(255) NOT NULL DEFAULT '',
+  `timezone` varchar(64) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `email` (`email`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- Create syntax for TABLE 'reps'
+CREATE TABLE IF NOT EXISTS `reps` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) unsigned NOT NULL,
+  `exercise` varchar(255) NOT NULL DEFAULT '',
+  `count` int(11) NOT NULL,
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  `challenge_id` int(11) unsigned DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`),
+  KEY `challenge_id` (`challenge_id`),
+  CONSTRAINT `reps_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- Create syntax for TABLE 'team' (offices are teams of kind 'office' and a user is on at most one of them)
+CREATE TABLE IF NOT EXISTS `team` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) DEFAULT NULL,
+  `kind` varchar(32) NOT NULL DEFAULT 'team',
+  `head_count` int(11) DEFAULT NULL,
+  `timezone` varchar(64) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- Create syntax for TABLE 'user_team'
+CREATE TABLE IF NOT EXISTS `user_team` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) unsigned NOT NULL,
+  `team_id` int(11) unsigned NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`),
+  KEY `team_id` (`team_id`),
+  CONSTRAINT `user_team_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION,
+  CONSTRAINT `user_team_ibfk_2` FOREIGN KEY (`team_id`) REFERENCES `team` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- Create syntax for TABLE 'exercise'
+CREATE TABLE IF NOT EXISTS `exercise` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL DEFAULT '',
+  `aliases` varchar(255) NOT NULL DEFAULT '',
+  `display_order` int(11) NOT NULL DEFAULT '0',
+  `active` tinyint(1) NOT NULL DEFAULT '1',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `name` (`name`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- The exercises we have always counted. Aliases are comma separated and usable in the recipient address
+INSERT IGNORE INTO `exercise` (`name`, `aliases`, `display_order`, `active`) VALUES
+  ('Pull Ups', 'pullup', 1, 1),
+  ('Push Ups', 'pushup', 2, 1),
+  ('Squats', 'squat,airsquats,airsquat', 3, 1),
+  ('Sit Ups', 'situp', 4, 1);
+
+-- Create syntax for TABLE 'challenge'
+CREATE TABLE IF NOT EXISTS `challenge` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL DEFAULT '',
+  `start_date` date NOT NULL,
+  `end_date` date NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `name` (`name`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- Create syntax for TABLE 'challenge_exercise' (no rows for a challenge means every active exercise counts)
+CREATE TABLE IF NOT EXISTS `challenge_exercise` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `challenge_id` int(11) unsigned NOT NULL,
+  `exercise_id` int(11) unsigned NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `challenge_id` (`challenge_id`),
+  KEY `exercise_id` (`exercise_id`),
+  CONSTRAINT `challenge_exercise_ibfk_1` FOREIGN KEY (`challenge_id`) REFERENCES `challenge` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION,
+  CONSTRAINT `challenge_exercise_ibfk_2` FOREIGN KEY (`exercise_id`) REFERENCES `exercise` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- Create syntax for TABLE 'challenge_team' (no rows for a challenge means every team participates)
+CREATE TABLE IF NOT EXISTS `challenge_team` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `challenge_id` int(11) unsigned NOT NULL,
+  `team_id` int(11) unsigned NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `challenge_id` (`challenge_id`),
+  KEY `team_id` (`team_id`),
+  CONSTRAINT `challenge_team_ibfk_1` FOREIGN KEY (`challenge_id`) REFERENCES `challenge` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION,
+  CONSTRAINT `challenge_team_ibfk_2` FOREIGN KEY (`team_id`) REFERENCES `team` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
@@ -0,0 +1,6 @@
+ALTER TABLE `reps`
+  DROP FOREIGN KEY `reps_ibfk_2`,
+  DROP KEY `submission_id`,
+  DROP COLUMN `submission_id`;
+
+DROP TABLE `submission`;
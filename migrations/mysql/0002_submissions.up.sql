@@ -0,0 +1,21 @@
+-- Each inbound email that logs reps is a submission, and its reps point back to it
+CREATE TABLE `submission` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) unsigned NOT NULL,
+  `sender` varchar(255) NOT NULL DEFAULT '',
+  `recipient` varchar(1024) NOT NULL DEFAULT '',
+  `subject` varchar(1024) NOT NULL DEFAULT '',
+  `message_id` varchar(255) NOT NULL DEFAULT '',
+  `received_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  `source` varchar(32) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`),
+  KEY `message_id` (`message_id`),
+  CONSTRAINT `submission_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- reps from before submissions existed have no submission
+ALTER TABLE `reps`
+  ADD COLUMN `submission_id` int(11) unsigned DEFAULT NULL,
+  ADD KEY `submission_id` (`submission_id`),
+  ADD CONSTRAINT `reps_ibfk_2` FOREIGN KEY (`submission_id`) REFERENCES `submission` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION;
@@ -0,0 +1,6 @@
+-- Message-IDs of inbound emails already handled, so a redelivery is not counted twice
+CREATE TABLE `processed_message` (
+  `message_id` varchar(255) NOT NULL,
+  `received_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`message_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1 @@
+DROP TABLE `queued_message`;
@@ -0,0 +1,11 @@
+-- Emails from senders not on the allowlist, held for an admin when -rejected-sender=queue
+CREATE TABLE `queued_message` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `sender` varchar(255) NOT NULL DEFAULT '',
+  `recipient` varchar(1024) NOT NULL DEFAULT '',
+  `subject` varchar(1024) NOT NULL DEFAULT '',
+  `body` text NOT NULL,
+  `message_id` varchar(255) NOT NULL DEFAULT '',
+  `received_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
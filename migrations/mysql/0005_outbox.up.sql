@@ -0,0 +1,14 @@
+-- Outbound email, written by OutboxEmailer and sent by the Outbox worker with retries
+CREATE TABLE `outbox` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `recipient` varchar(255) NOT NULL DEFAULT '',
+  `subject` varchar(1024) NOT NULL DEFAULT '',
+  `body` mediumtext NOT NULL,
+  `status` varchar(16) NOT NULL DEFAULT 'pending',
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `last_error` varchar(1024) NOT NULL DEFAULT '',
+  `next_attempt_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `status_next_attempt_at` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
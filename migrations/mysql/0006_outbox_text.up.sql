@@ -0,0 +1,2 @@
+-- Emails are sent with a plain text part alongside the html in body
+ALTER TABLE `outbox` ADD COLUMN `text_body` mediumtext NOT NULL AFTER `subject`;
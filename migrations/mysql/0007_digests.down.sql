@@ -0,0 +1,3 @@
+DROP TABLE `digest_sent`;
+
+ALTER TABLE `user` DROP COLUMN `digest`;
@@ -0,0 +1,12 @@
+-- The digest emails each user opted in to, ie, "daily,weekly". Empty is none.
+ALTER TABLE `user` ADD COLUMN `digest` varchar(32) NOT NULL DEFAULT '';
+
+-- Digests already sent, by the day they were for, so each goes out once
+CREATE TABLE `digest_sent` (
+  `user_id` int(11) unsigned NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `day` varchar(10) NOT NULL,
+  `sent_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `kind`, `day`),
+  CONSTRAINT `digest_sent_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
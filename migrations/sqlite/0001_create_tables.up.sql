@@ -0,0 +1,76 @@
+-- SQLite translation of mysql/0001_create_tables.up.sql
+
+-- Create syntax for TABLE 'user'
+CREATE TABLE IF NOT EXISTS `user` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `email` varchar(255) NOT NULL DEFAULT '' UNIQUE,
+  `timezone` varchar(64) DEFAULT NULL
+);
+
+-- Create syntax for TABLE 'reps'
+CREATE TABLE IF NOT EXISTS `reps` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `user_id` INTEGER NOT NULL REFERENCES `user` (`id`) ON DELETE CASCADE,
+  `exercise` varchar(255) NOT NULL DEFAULT '',
+  `count` INTEGER NOT NULL,
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  `challenge_id` INTEGER DEFAULT NULL
+);
+CREATE INDEX IF NOT EXISTS `reps_user_id` ON `reps` (`user_id`);
+CREATE INDEX IF NOT EXISTS `reps_challenge_id` ON `reps` (`challenge_id`);
+
+-- Create syntax for TABLE 'team' (offices are teams of kind 'office' and a user is on at most one of them)
+CREATE TABLE IF NOT EXISTS `team` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `name` varchar(255) DEFAULT NULL,
+  `kind` varchar(32) NOT NULL DEFAULT 'team',
+  `head_count` INTEGER DEFAULT NULL,
+  `timezone` varchar(64) DEFAULT NULL
+);
+
+-- Create syntax for TABLE 'user_team'
+CREATE TABLE IF NOT EXISTS `user_team` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `user_id` INTEGER NOT NULL REFERENCES `user` (`id`) ON DELETE CASCADE,
+  `team_id` INTEGER NOT NULL REFERENCES `team` (`id`) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `user_team_user_id` ON `user_team` (`user_id`);
+CREATE INDEX IF NOT EXISTS `user_team_team_id` ON `user_team` (`team_id`);
+
+-- Create syntax for TABLE 'exercise'
+CREATE TABLE IF NOT EXISTS `exercise` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `name` varchar(255) NOT NULL DEFAULT '' UNIQUE,
+  `aliases` varchar(255) NOT NULL DEFAULT '',
+  `display_order` INTEGER NOT NULL DEFAULT 0,
+  `active` INTEGER NOT NULL DEFAULT 1
+);
+
+-- The exercises we have always counted. Aliases are comma separated and usable in the recipient address
+INSERT OR IGNORE INTO `exercise` (`name`, `aliases`, `display_order`, `active`) VALUES
+  ('Pull Ups', 'pullup', 1, 1),
+  ('Push Ups', 'pushup', 2, 1),
+  ('Squats', 'squat,airsquats,airsquat', 3, 1),
+  ('Sit Ups', 'situp', 4, 1);
+
+-- Create syntax for TABLE 'challenge'
+CREATE TABLE IF NOT EXISTS `challenge` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `name` varchar(255) NOT NULL DEFAULT '' UNIQUE,
+  `start_date` date NOT NULL,
+  `end_date` date NOT NULL
+);
+
+-- Create syntax for TABLE 'challenge_exercise' (no rows for a challenge means every active exercise counts)
+CREATE TABLE IF NOT EXISTS `challenge_exercise` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `challenge_id` INTEGER NOT NULL REFERENCES `challenge` (`id`) ON DELETE CASCADE,
+  `exercise_id` INTEGER NOT NULL REFERENCES `exercise` (`id`) ON DELETE CASCADE
+);
+
+-- Create syntax for TABLE 'challenge_team' (no rows for a challenge means every team participates)
+CREATE TABLE IF NOT EXISTS `challenge_team` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `challenge_id` INTEGER NOT NULL REFERENCES `challenge` (`id`) ON DELETE CASCADE,
+  `team_id` INTEGER NOT NULL REFERENCES `team` (`id`) ON DELETE CASCADE
+);
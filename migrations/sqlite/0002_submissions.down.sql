@@ -0,0 +1,4 @@
+DROP INDEX `reps_submission_id`;
+ALTER TABLE `reps` DROP COLUMN `submission_id`;
+
+DROP TABLE `submission`;
@@ -0,0 +1,18 @@
+-- SQLite translation of mysql/0002_submissions.up.sql
+
+CREATE TABLE `submission` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `user_id` INTEGER NOT NULL REFERENCES `user` (`id`) ON DELETE CASCADE,
+  `sender` varchar(255) NOT NULL DEFAULT '',
+  `recipient` varchar(1024) NOT NULL DEFAULT '',
+  `subject` varchar(1024) NOT NULL DEFAULT '',
+  `message_id` varchar(255) NOT NULL DEFAULT '',
+  `received_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  `source` varchar(32) NOT NULL DEFAULT ''
+);
+CREATE INDEX `submission_user_id` ON `submission` (`user_id`);
+CREATE INDEX `submission_message_id` ON `submission` (`message_id`);
+
+-- SQLite cannot drop a column that has a foreign key, so the reference is left to the code
+ALTER TABLE `reps` ADD COLUMN `submission_id` INTEGER DEFAULT NULL;
+CREATE INDEX `reps_submission_id` ON `reps` (`submission_id`);
@@ -0,0 +1,6 @@
+-- SQLite translation of mysql/0003_processed_messages.up.sql
+
+CREATE TABLE `processed_message` (
+  `message_id` varchar(255) NOT NULL PRIMARY KEY,
+  `received_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP
+);
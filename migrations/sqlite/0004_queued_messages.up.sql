@@ -0,0 +1,11 @@
+-- SQLite translation of mysql/0004_queued_messages.up.sql
+
+CREATE TABLE `queued_message` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `sender` varchar(255) NOT NULL DEFAULT '',
+  `recipient` varchar(1024) NOT NULL DEFAULT '',
+  `subject` varchar(1024) NOT NULL DEFAULT '',
+  `body` text NOT NULL DEFAULT '',
+  `message_id` varchar(255) NOT NULL DEFAULT '',
+  `received_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,14 @@
+-- SQLite translation of mysql/0005_outbox.up.sql
+
+CREATE TABLE `outbox` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `recipient` varchar(255) NOT NULL DEFAULT '',
+  `subject` varchar(1024) NOT NULL DEFAULT '',
+  `body` text NOT NULL DEFAULT '',
+  `status` varchar(16) NOT NULL DEFAULT 'pending',
+  `attempts` INTEGER NOT NULL DEFAULT 0,
+  `last_error` varchar(1024) NOT NULL DEFAULT '',
+  `next_attempt_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX `outbox_status_next_attempt_at` ON `outbox` (`status`, `next_attempt_at`);
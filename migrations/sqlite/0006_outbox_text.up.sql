@@ -0,0 +1,3 @@
+-- SQLite translation of mysql/0006_outbox_text.up.sql
+
+ALTER TABLE `outbox` ADD COLUMN `text_body` text NOT NULL DEFAULT '';
@@ -0,0 +1,11 @@
+-- SQLite translation of mysql/0007_digests.up.sql
+
+ALTER TABLE `user` ADD COLUMN `digest` varchar(32) NOT NULL DEFAULT '';
+
+CREATE TABLE `digest_sent` (
+  `user_id` INTEGER NOT NULL REFERENCES `user` (`id`) ON DELETE CASCADE,
+  `kind` varchar(16) NOT NULL,
+  `day` varchar(10) NOT NULL,
+  `sent_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`, `kind`, `day`)
+);
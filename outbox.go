@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Outbox statuses
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	// OutboxDead is an email that failed OutboxMaxAttempts times and is no longer retried
+	OutboxDead = "dead"
+)
+
+// OutboxMaxAttempts is how many times an email is tried before it is marked dead
+var OutboxMaxAttempts = 8
+
+// OutboxBackoff is the wait before the first retry; it doubles with each failure, up to outboxMaxBackoff
+var OutboxBackoff = time.Minute
+
+// outboxMaxBackoff caps the wait between retries
+const outboxMaxBackoff = 6 * time.Hour
+
+// outboxClaimLease is how long an email claimed by a worker is left to it; after that it is due again, in case that worker died
+const outboxClaimLease = 10 * time.Minute
+
+// OutboxSentTTL is how long sent emails are kept before the Janitor deletes them
+var OutboxSentTTL = 30 * 24 * time.Hour
+
+// OutboxEmail is a row of the outbox table
+type OutboxEmail struct {
+	ID            int
+	To            string
+	Subject       string
+	Text          string
+	HTML          string
+	Status        string
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+}
+
+// OutboxEmailer matches the Emailer interface by saving the email to the outbox, so replies survive a mail provider outage
+// and handlers don't wait on it. An Outbox sends them.
+type OutboxEmailer struct {
+	Store Store
+}
+
+// SendEmail saves the email to be sent as soon as possible
+func (e OutboxEmailer) SendEmail(to string, subject string, text string, html string) error {
+	return e.Store.AddOutboxEmail(&OutboxEmail{To: to, Subject: subject, Text: text, HTML: html, NextAttemptAt: time.Now()})
+}
+
+// Outbox is the background worker that sends what OutboxEmailer saved, retrying failures with exponential backoff.
+// Each email is claimed before it is sent, so more than one server can share the database.
+type Outbox struct {
+	Store  Store
+	Sender Emailer
+	// PollInterval is how often to look for due emails
+	PollInterval time.Duration
+
+	close chan struct{}
+}
+
+// NewOutbox creates a worker that sends through sender
+func NewOutbox(store Store, sender Emailer) *Outbox {
+	return &Outbox{
+		Store:        store,
+		Sender:       sender,
+		PollInterval: 5 * time.Second,
+		close:        make(chan struct{}),
+	}
+}
+
+// Run sends due emails every PollInterval until Close
+func (o *Outbox) Run() {
+	ticker := time.NewTicker(o.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := o.SendDue(time.Now()); err != nil {
+			logError(nil, err, "unable to send outbox")
+		}
+		select {
+		case <-o.close:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops Run
+func (o *Outbox) Close() error {
+	close(o.close)
+	return nil
+}
+
+// SendDue tries every pending email whose next attempt is at or before now, and returns how many were sent
+func (o *Outbox) SendDue(now time.Time) (int, error) {
+	due, err := o.Store.GetDueOutboxEmails(now)
+	if err != nil {
+		return 0, err
+	}
+	var sent int
+	for _, email := range due {
+		claimed, err := o.Store.ClaimOutboxEmail(email.ID, now, now.Add(outboxClaimLease))
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			// another server is sending it
+			continue
+		}
+		sendErr := o.Sender.SendEmail(email.To, email.Subject, email.Text, email.HTML)
+		if sendErr == nil {
+			err = o.Store.MarkOutboxEmailSent(email.ID)
+			if err != nil {
+				// it was sent, so don't return and risk sending the rest twice
+				logError(nil, err, fmt.Sprintf("unable to mark outbox email %d sent", email.ID))
+			}
+			sent++
+			continue
+		}
+
+		email.Attempts++
+		email.LastError = sendErr.Error()
+		if email.Attempts >= OutboxMaxAttempts {
+			email.Status = OutboxDead
+			logEvent(nil, "outbox_dead", fmt.Sprintf("gave up on email %d to %s after %d attempts: %v", email.ID, email.To, email.Attempts, sendErr))
+		} else {
+			email.NextAttemptAt = now.Add(outboxBackoff(email.Attempts))
+			logError(nil, sendErr, fmt.Sprintf("unable to send outbox email %d to %s, attempt %d; retrying at %s", email.ID, email.To, email.Attempts, email.NextAttemptAt.Format(time.RFC3339)))
+		}
+		err = o.Store.MarkOutboxEmailFailed(email)
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// outboxBackoff is the wait after the given number of failed attempts: OutboxBackoff, doubling each time, up to outboxMaxBackoff
+func outboxBackoff(attempts int) time.Duration {
+	wait := OutboxBackoff
+	for i := 1; i < attempts && wait < outboxMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > outboxMaxBackoff {
+		wait = outboxMaxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// QueuedMessage is an email from a sender not on the allowlist, held until an admin approves or rejects it
+type QueuedMessage struct {
+	ID int
+	inboundMessage
+}
+
+// rejectSender handles mail from a sender not on the allowlist according to RejectedSenderPolicy
+func (s *Server) rejectSender(r *http.Request, msg inboundMessage) {
+	switch RejectedSenderPolicy {
+	case SenderBounce:
+		logEvent(r, "sender_rejected", fmt.Sprintf("bounced %s", msg.From))
+		err := s.SendErrorEmail(msg.From, msg.To, msg.Subject, fmt.Sprintf(ErrFromFmt, msg.From))
+		if err != nil {
+			logError(r, err, "unable to send rejected sender email")
+		}
+	case SenderQueue:
+		qm := &QueuedMessage{inboundMessage: msg}
+		err := s.Store.QueueMessage(qm)
+		if err != nil {
+			logError(r, err, fmt.Sprintf("unable to queue message from %s", msg.From))
+			return
+		}
+		logEvent(r, "sender_queued", fmt.Sprintf("queued message %d from %s", qm.ID, msg.From))
+	default:
+		logEvent(r, "sender_rejected", fmt.Sprintf("dropped message from %s", msg.From))
+	}
+}
+
+// runQueue is the queue subcommand: list shows the held messages, approve runs one as if its sender were allowed, and reject deletes one
+func (s *Server) runQueue(args []string, w io.Writer) error {
+	usage := fmt.Errorf("usage: %s queue list|approve ID|reject ID", AppName)
+	if len(args) == 0 {
+		return usage
+	}
+
+	if args[0] == "list" && len(args) == 1 {
+		queued, err := s.Store.GetQueuedMessages()
+		if err != nil {
+			return err
+		}
+		if len(queued) == 0 {
+			fmt.Fprintln(w, "no queued messages")
+		}
+		for _, qm := range queued {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%q\n", qm.ID, qm.ReceivedAt.Format("2006-01-02 15:04"), qm.From, qm.To, qm.Subject)
+		}
+		return nil
+	}
+
+	if (args[0] != "approve" && args[0] != "reject") || len(args) != 2 {
+		return usage
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return usage
+	}
+	qm, err := s.Store.GetQueuedMessage(id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no queued message %d", id)
+	} else if err != nil {
+		return err
+	}
+
+	// take it off the queue first so it can't be approved twice
+	err = s.Store.RemoveQueuedMessage(id)
+	if err != nil {
+		return err
+	}
+	if args[0] == "approve" {
+		qm.Source = SourceQueue
+		s.processMessage(nil, qm.inboundMessage, true)
+		fmt.Fprintf(w, "approved %d from %s\n", qm.ID, qm.From)
+	} else {
+		fmt.Fprintf(w, "rejected %d from %s\n", qm.ID, qm.From)
+	}
+	logEvent(nil, "queue_"+args[0], fmt.Sprintf("%s message %d from %s", args[0], qm.ID, qm.From))
+	return nil
+}
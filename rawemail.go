@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// parseRawEmail reads the email field sent when Inbound Parse is set to "POST the raw, full MIME message".
+// It fills in the same fields as the parsed form: To, From, Subject, Text, and MessageID.
+func parseRawEmail(raw string) (inboundMessage, error) {
+	var msg inboundMessage
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return msg, errors.Wrap(err, "unable to read raw email")
+	}
+
+	msg.To = decodeHeader(m.Header.Get("To"))
+	msg.From = decodeHeader(m.Header.Get("From"))
+	msg.Subject = decodeHeader(m.Header.Get("Subject"))
+	msg.MessageID = strings.TrimSpace(m.Header.Get("Message-Id"))
+
+	text, isHTML, err := textBody(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	if err != nil {
+		return msg, err
+	}
+	if isHTML {
+		text = htmlToText(text)
+	}
+	msg.Text = text
+	return msg, nil
+}
+
+// wordDecoder decodes RFC 2047 encoded-words, ie, =?ISO-8859-1?Q?Team_Add:_caf=E9?=, in any charset htmlindex knows
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// decodeHeader decodes any encoded-words in the header, leaving it as is if they are malformed
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		logError(nil, err, fmt.Sprintf("unable to decode header %q", value))
+		return value
+	}
+	return decoded
+}
+
+// charsetReader converts from the named charset, ie, windows-1252 or iso-8859-15, to UTF-8
+func charsetReader(charset string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return r, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(r), nil
+}
+
+// textBody finds the body to read commands from, decoded to UTF-8. A text/plain part is preferred;
+// otherwise the first text/html part is returned with isHTML set. Attachments are skipped.
+func textBody(contentType string, transferEncoding string, body io.Reader) (text string, isHTML bool, err error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// RFC 2045 says a missing or broken Content-Type is plain ascii text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		var htmlText string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return "", false, errors.Wrap(err, "unable to read multipart body")
+			}
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+			partText, partIsHTML, err := textBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				// one unreadable part shouldn't lose the others
+				logError(nil, err, "skipping unreadable part")
+				continue
+			}
+			if partText == "" {
+				continue
+			}
+			if !partIsHTML {
+				return partText, false, nil
+			}
+			if htmlText == "" {
+				htmlText = partText
+			}
+		}
+		return htmlText, htmlText != "", nil
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", false, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	// an unknown charset is read as is, since commands are usually plain ascii anyway
+	decoded, err := charsetReader(params["charset"], body)
+	if err != nil {
+		logError(nil, err, "reading body without charset conversion")
+	} else {
+		body = decoded
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "unable to read %s body", mediaType)
+	}
+	return string(b), mediaType == "text/html", nil
+}
+
+// htmlHidden matches elements whose content is not shown, htmlBreak matches the tags that end a line, and htmlTag matches any tag
+var (
+	htmlHidden = regexp.MustCompile(`(?is)<(head|style|script)[^>]*>.*?</(head|style|script)>`)
+	htmlBreak  = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|tr|h[1-6])>`)
+	htmlTag    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// htmlToText keeps the lines of an html body, for senders that only send html
+func htmlToText(s string) string {
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
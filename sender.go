@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SenderList is who may send commands: domains (example.com), wildcard subdomains (*.example.com, not example.com itself),
+// exact addresses (someone@example.com), or "*" for anyone. It is set from a comma separated flag.
+type SenderList []string
+
+// AllowedSenders is the sender allowlist; mail from anyone else is handled by RejectedSenderPolicy
+var AllowedSenders = SenderList{"sendgrid.com"}
+
+// Policies for mail from a sender not on the allowlist
+const (
+	// SenderDrop logs the message and does nothing else
+	SenderDrop = "drop"
+	// SenderBounce replies with ErrFromFmt
+	SenderBounce = "bounce"
+	// SenderQueue holds the message in queued_message until an admin approves or rejects it
+	SenderQueue = "queue"
+)
+
+// RejectedSenderPolicy is what happens to mail from a sender not on the allowlist
+var RejectedSenderPolicy = SenderDrop
+
+// validSenderPolicy reports if the policy is one of SenderDrop, SenderBounce, or SenderQueue
+func validSenderPolicy(policy string) bool {
+	return policy == SenderDrop || policy == SenderBounce || policy == SenderQueue
+}
+
+// String is the comma separated list, for the flag package
+func (l *SenderList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+// Set replaces the list with the comma separated entries in v
+func (l *SenderList) Set(v string) error {
+	var entries []string
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		// the only wildcards are "*" and a leading "*."
+		rest := strings.TrimPrefix(entry, "*.")
+		if entry != "*" && (strings.Contains(rest, "*") || rest == "" || strings.HasPrefix(rest, "@") || strings.HasSuffix(rest, "@")) {
+			return fmt.Errorf("%q is not a domain, *.domain, or email address", entry)
+		}
+		entries = append(entries, entry)
+	}
+	*l = entries
+	return nil
+}
+
+// Allows reports if the address is on the list
+func (l SenderList) Allows(addr string) bool {
+	addr = strings.ToLower(strings.TrimSpace(extractEmailAddr(addr)))
+	at := strings.LastIndex(addr, "@")
+	if at <= 0 || at == len(addr)-1 {
+		return false
+	}
+	domain := addr[at+1:]
+	for _, entry := range l {
+		switch {
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "@"):
+			if addr == entry {
+				return true
+			}
+		case strings.HasPrefix(entry, "*."):
+			if strings.HasSuffix(domain, entry[1:]) {
+				return true
+			}
+		case domain == entry:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+-- Attributes reps to challenges. Run once against an existing database after add_timezones.sql and before the first migrate up:
+-- mysql countmyreps < setup/add_challenges.sql
+-- To backfill past seasons, insert them into `challenge` between the CREATE TABLE and the UPDATE, or rerun the UPDATE (also in handy_queries.sql) after inserting them.
+
+ALTER TABLE `reps`
+  ADD COLUMN `challenge_id` int(11) unsigned DEFAULT NULL,
+  ADD KEY `challenge_id` (`challenge_id`);
+
+-- the same definition as migrations/mysql/0001_create_tables.up.sql, which skips it once it exists
+CREATE TABLE IF NOT EXISTS `challenge` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL DEFAULT '',
+  `start_date` date NOT NULL,
+  `end_date` date NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `name` (`name`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+-- attribute reps to the challenge that was running when they were created
+UPDATE `reps` JOIN `challenge` ON DATE(`reps`.`created_at`) >= `challenge`.`start_date` AND DATE(`reps`.`created_at`) <= `challenge`.`end_date`
+  SET `reps`.`challenge_id` = `challenge`.`id`
+  WHERE `reps`.`challenge_id` IS NULL;
@@ -0,0 +1,11 @@
+-- Adds IANA timezones to users and teams. Run once against an existing database after migrate_offices_to_teams.sql:
+-- mysql countmyreps < setup/add_timezones.sql
+
+ALTER TABLE `user` ADD COLUMN `timezone` varchar(64) DEFAULT NULL;
+ALTER TABLE `team` ADD COLUMN `timezone` varchar(64) DEFAULT NULL;
+
+-- the offices we used to shift by hand relative to the server's America/Los_Angeles clock
+UPDATE `team` SET `timezone` = 'America/Denver' WHERE `kind` = 'office' AND `name` = 'Denver';
+UPDATE `team` SET `timezone` = 'Europe/Bucharest' WHERE `kind` = 'office' AND `name` = 'Romania';
+UPDATE `team` SET `timezone` = 'America/New_York' WHERE `kind` = 'office' AND `name` = 'NY';
+UPDATE `team` SET `timezone` = 'Europe/London' WHERE `kind` = 'office' AND `name` = 'London';
@@ -0,0 +1,27 @@
+-- One-shot migration that turns each office into a team of kind 'office' and retires the office table.
+-- Run once against an existing database: mysql countmyreps < setup/migrate_offices_to_teams.sql
+
+ALTER TABLE `team`
+  ADD COLUMN `kind` varchar(32) NOT NULL DEFAULT 'team',
+  ADD COLUMN `head_count` int(11) DEFAULT NULL;
+
+-- a team that already has an office's name becomes that office
+UPDATE `team` JOIN `office` ON `team`.`name` = `office`.`name`
+  SET `team`.`kind` = 'office', `team`.`head_count` = `office`.`head_count`
+  WHERE `office`.`name` != '';
+
+-- every other office becomes a new team; the magic empty string office is dropped
+INSERT INTO `team` (`name`, `kind`, `head_count`)
+  SELECT `office`.`name`, 'office', `office`.`head_count` FROM `office`
+  WHERE `office`.`name` != '' AND NOT EXISTS (SELECT 1 FROM `team` WHERE `team`.`name` = `office`.`name`);
+
+-- users join their office's team
+INSERT INTO `user_team` (`user_id`, `team_id`)
+  SELECT `user`.`id`, `team`.`id` FROM `user`
+  JOIN `office` ON `user`.`office` = `office`.`id`
+  JOIN `team` ON `team`.`name` = `office`.`name` AND `team`.`kind` = 'office'
+  WHERE NOT EXISTS (SELECT 1 FROM `user_team` WHERE `user_team`.`user_id` = `user`.`id` AND `user_team`.`team_id` = `team`.`id`);
+
+ALTER TABLE `user` DROP FOREIGN KEY `user_ibfk_1`;
+ALTER TABLE `user` DROP COLUMN `office`;
+DROP TABLE `office`;
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPMaxSize is the largest message the SMTP listener accepts, in bytes
+var SMTPMaxSize int64 = 10 << 20
+
+// smtpTimeout is how long the SMTP listener waits on a client for each command
+const smtpTimeout = 5 * time.Minute
+
+// SMTPServer receives mail directly, so self hosters can forward mail from their own mail server instead of using a mail provider.
+// It accepts one recipient per message, in Domains, and hands each message to Deliver.
+type SMTPServer struct {
+	Port    int
+	Domains []string
+	// Deliver handles a message and reports false if it can't be read. NewSMTPServer runs it through the same commands as the webhooks.
+	Deliver func(from string, rcpt string, data string) bool
+
+	listener net.Listener
+}
+
+// NewSMTPServer listens on the host and port (0 picks a free one and sets Port); Serve accepts the connections.
+// There is no SPF or DKIM check, so host should only be reachable by trusted mail servers, ie, 127.0.0.1.
+func NewSMTPServer(s *Server, host string, port int, domains []string) (*SMTPServer, error) {
+	return listenSMTP(host, port, domains, s.receiveSMTP)
+}
+
+// listenSMTP listens on the host and port for mail to the domains, handing each message to deliver
+func listenSMTP(host string, port int, domains []string, deliver func(from string, rcpt string, data string) bool) (*SMTPServer, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return &SMTPServer{
+		Port:     l.Addr().(*net.TCPAddr).Port,
+		Domains:  domains,
+		Deliver:  deliver,
+		listener: l,
+	}, nil
+}
+
+// Serve blocks, handling each connection in its own goroutine, until Close
+func (m *SMTPServer) Serve() error {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go m.handleConn(conn)
+	}
+}
+
+// Close stops accepting connections
+func (m *SMTPServer) Close() error {
+	return m.listener.Close()
+}
+
+// acceptsRecipient reports if the address is in one of the accepted domains
+func (m *SMTPServer) acceptsRecipient(addr string) bool {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(addr[at+1:])
+	for _, d := range m.Domains {
+		if strings.ToLower(strings.TrimSpace(d)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// handleConn speaks enough SMTP (RFC 5321) to receive mail: HELO/EHLO, MAIL, RCPT, DATA, RSET, NOOP, and QUIT
+func (m *SMTPServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	remote := conn.RemoteAddr().String()
+
+	reply := func(format string, args ...interface{}) bool {
+		conn.SetDeadline(time.Now().Add(smtpTimeout))
+		return tp.PrintfLine(format, args...) == nil
+	}
+
+	var from, rcpt string
+	if !reply("220 %s ESMTP %s", EmailDomain, AppName) {
+		return
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(smtpTimeout))
+		line, err := tp.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				logError(nil, err, "smtp read from "+remote)
+			}
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply("250 %s", EmailDomain)
+		case "EHLO":
+			reply("250-%s\r\n250-SIZE %d\r\n250-8BITMIME\r\n250 PIPELINING", EmailDomain, SMTPMaxSize)
+		case "MAIL":
+			addr, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				reply("501 5.5.4 syntax: MAIL FROM:<address>")
+				continue
+			}
+			from, rcpt = addr, ""
+			reply("250 2.1.0 OK")
+		case "RCPT":
+			addr, ok := smtpPath(arg, "TO:")
+			switch {
+			case !ok || addr == "":
+				reply("501 5.5.4 syntax: RCPT TO:<address>")
+			case rcpt != "":
+				// each recipient names its own exercises, so the client sends the message again for the next one
+				reply("452 4.5.3 one recipient per message")
+			case !m.acceptsRecipient(addr):
+				logEvent(nil, "smtp_rejected", fmt.Sprintf("recipient %s from %s", addr, remote))
+				reply("550 5.7.1 relaying to %s is not permitted", addr)
+			default:
+				rcpt = addr
+				reply("250 2.1.5 OK")
+			}
+		case "DATA":
+			if rcpt == "" {
+				reply("503 5.5.1 RCPT first")
+				continue
+			}
+			if !reply("354 end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(smtpTimeout))
+			dr := tp.DotReader()
+			data, err := ioutil.ReadAll(io.LimitReader(dr, SMTPMaxSize+1))
+			if err != nil {
+				logError(nil, err, "smtp data from "+remote)
+				return
+			}
+			if int64(len(data)) > SMTPMaxSize {
+				// read the rest, so the connection is ready for the next command
+				io.Copy(ioutil.Discard, dr)
+				reply("552 5.3.4 message is larger than %d bytes", SMTPMaxSize)
+			} else if m.Deliver(from, rcpt, string(data)) {
+				reply("250 2.0.0 OK")
+			} else {
+				reply("554 5.6.0 unable to read message")
+			}
+			from, rcpt = "", ""
+		case "RSET":
+			from, rcpt = "", ""
+			reply("250 2.0.0 OK")
+		case "NOOP":
+			reply("250 2.0.0 OK")
+		case "QUIT":
+			reply("221 2.0.0 bye")
+			return
+		default:
+			reply("502 5.5.2 command not implemented")
+		}
+	}
+}
+
+// receiveSMTP runs a message from the SMTP listener for the envelope recipient, which picks the exercises.
+// The envelope sender is who the reps are for; the From header is whatever the client wrote, so it is ignored.
+// It reports false if the message can't be read.
+func (s *Server) receiveSMTP(from string, rcpt string, data string) bool {
+	msg, err := parseRawEmail(data)
+	if err != nil {
+		logError(nil, err, "unable to parse smtp message from "+from)
+		return false
+	}
+	msg.To = rcpt
+	msg.From = from
+	msg.Source = SourceSMTP
+	msg.ReceivedAt = time.Now()
+	s.receive(nil, msg)
+	return true
+}
+
+// smtpPath reads the address from "FROM:<a@b.com> SIZE=100" or "TO:<a@b.com>". The null sender, <>, is an empty address.
+func smtpPath(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	// anything after the path is an ESMTP parameter, ie, SIZE=100
+	if i := strings.Index(path, " "); i >= 0 {
+		path = path[:i]
+	}
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+	return path[1 : len(path)-1], true
+}
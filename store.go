@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Store is the data layer behind the server. MySQLStore is what runs in production.
+// Read methods that return no error log their errors and return what they have, same as the handlers expect.
+type Store interface {
+	// users
+	GetOrCreateUserID(email string) (int, error)
+	GetUserOffice(email string) string
+	GetUserTeams(email string) []string
+	GetUserLocation(email string) *time.Location
+	SetUserTimezone(timezone string, userID int) error
+
+	// teams
+	GetOffices() ([]string, error)
+	GetTeamNames() ([]string, error)
+	GetTeamMemberTotals(c Challenge, teamName string) (map[string]int, error)
+	AddTeam(teamName string, userID int) error
+	RemoveTeam(teamName string, userID int) error
+	SetOffice(officeName string, userID int) error
+
+	// exercises and challenges
+	GetExercises() ([]Exercise, error)
+	GetChallenges() ([]Challenge, error)
+	GetChallenge(name string) (Challenge, error)
+	GetActiveChallenge(t time.Time) (Challenge, error)
+	GetCurrentChallenge(t time.Time) (Challenge, error)
+
+	// reps
+	AddSubmission(sub *Submission, challengeID sql.NullInt64) error
+	GetTodaysReps(email string) []RepData
+	GetUserReps(c Challenge, email string) []RepData
+	GetTeamReps(c Challenge) map[string][]RepData
+	GetLastSubmission(email string) (Submission, error)
+	RemoveSubmission(sub Submission) error
+
+	// inbound messages
+	// IsMessageProcessed reports if the Message-ID was recorded by MarkMessageProcessed
+	IsMessageProcessed(messageID string) (bool, error)
+	// MarkMessageProcessed records the Message-ID and reports false if it was already recorded
+	MarkMessageProcessed(messageID string) (bool, error)
+	// PruneProcessedMessages forgets the Message-IDs recorded before the time, and returns how many
+	PruneProcessedMessages(before time.Time) (int64, error)
+	QueueMessage(qm *QueuedMessage) error
+	GetQueuedMessages() ([]QueuedMessage, error)
+	GetQueuedMessage(id int) (QueuedMessage, error)
+	RemoveQueuedMessage(id int) error
+
+	// outbound email
+	AddOutboxEmail(email *OutboxEmail) error
+	GetDueOutboxEmails(now time.Time) ([]OutboxEmail, error)
+	// ClaimOutboxEmail pushes a due email's next attempt to until, and reports false if another worker claimed it first
+	ClaimOutboxEmail(id int, now time.Time, until time.Time) (bool, error)
+	MarkOutboxEmailSent(id int) error
+	MarkOutboxEmailFailed(email OutboxEmail) error
+	GetStuckOutboxEmails() ([]OutboxEmail, error)
+	// PruneOutboxEmails deletes the sent emails created before the time, and returns how many
+	PruneOutboxEmails(before time.Time) (int64, error)
+
+	// digests
+	SetUserDigest(digest string, userID int) error
+	GetDigestUsers() ([]DigestUser, error)
+	// IsDigestSent reports if the user's digest for the day was recorded
+	IsDigestSent(userID int, kind string, day string) (bool, error)
+	// MarkDigestSent records the user's digest for the day and reports false if it was already recorded
+	MarkDigestSent(userID int, kind string, day string) (bool, error)
+
+	// stats
+	GetTeamStats(c Challenge) map[string]Stats
+	GetOfficeStats(c Challenge) map[string]Stats
+
+	// Ping verifies the store is reachable
+	Ping() error
+	// Close releases the underlying connection
+	Close() error
+}
+
+// MySQLStore is the Store backed by MySQL (or MariaDB)
+type MySQLStore struct {
+	DB *sql.DB
+}
+
+// NewMySQLStore wraps an open db connection
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{DB: db}
+}
+
+// AddSubmission records the submission and inserts one row of reps per exercise, in order, all in one transaction. It sets sub.ID.
+func (s *MySQLStore) AddSubmission(sub *Submission, challengeID sql.NullInt64) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin submission transaction")
+	}
+	defer tx.Rollback()
+
+	q := "INSERT INTO submission (user_id, sender, recipient, subject, message_id, received_at, source) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	args := []interface{}{sub.UserID, sub.Sender, sub.To, sub.Subject, sub.MessageID, sub.ReceivedAt.UTC(), sub.Source}
+	res, err := tx.Exec(q, args...)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, args...))
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "unable to get submission id")
+	}
+
+	creditedAt := sub.CreditedAt
+	if creditedAt.IsZero() {
+		creditedAt = sub.ReceivedAt
+	}
+	if len(sub.Exercises) > 0 {
+		values := make([]string, len(sub.Exercises))
+		args = nil
+		for i, exercise := range sub.Exercises {
+			values[i] = "(?, ?, ?, ?, ?, ?)"
+			args = append(args, exercise, sub.Counts[exercise], sub.UserID, challengeID, id, creditedAt.UTC())
+		}
+		q = fmt.Sprintf("INSERT INTO reps (exercise, count, user_id, challenge_id, submission_id, created_at) VALUES %s", strings.Join(values, ", "))
+		_, err = tx.Exec(q, args...)
+		if err != nil {
+			return errors.Wrap(err, queryPrinter(q, args...))
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "unable to commit submission")
+	}
+	sub.ID = int(id)
+	return nil
+}
+
+// GetLastSubmission is the user's most recent submission and its reps. It returns sql.ErrNoRows if there is none.
+func (s *MySQLStore) GetLastSubmission(email string) (Submission, error) {
+	var sub Submission
+	q := "SELECT submission.id, submission.user_id, sender, recipient, subject, message_id, received_at, source FROM submission JOIN user ON submission.user_id=user.id WHERE user.email=? ORDER BY submission.id DESC LIMIT 1"
+	row := s.DB.QueryRow(q, email)
+	err := row.Scan(&sub.ID, &sub.UserID, &sub.Sender, &sub.To, &sub.Subject, &sub.MessageID, &sub.ReceivedAt, &sub.Source)
+	if err == sql.ErrNoRows {
+		return sub, err
+	} else if err != nil {
+		return sub, errors.Wrap(err, queryPrinter(q, email))
+	}
+
+	sub.Counts = make(map[string]int)
+	q = "SELECT exercise, count FROM reps WHERE submission_id=? ORDER BY id"
+	rows, err := s.DB.Query(q, sub.ID)
+	if err != nil {
+		return sub, errors.Wrap(err, queryPrinter(q, sub.ID))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var exercise string
+		var count int
+		err = rows.Scan(&exercise, &count)
+		if err != nil {
+			return sub, errors.Wrap(err, queryPrinter(q, sub.ID))
+		}
+		if _, ok := sub.Counts[exercise]; !ok {
+			sub.Exercises = append(sub.Exercises, exercise)
+		}
+		sub.Counts[exercise] += count
+	}
+	if rows.Err() != nil {
+		return sub, rows.Err()
+	}
+	return sub, nil
+}
+
+// RemoveSubmission deletes the submission and its reps
+func (s *MySQLStore) RemoveSubmission(sub Submission) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin remove submission transaction")
+	}
+	defer tx.Rollback()
+
+	// SQLite has no foreign key from reps to submission, so do not rely on the cascade
+	for _, q := range []string{"DELETE FROM reps WHERE submission_id=?", "DELETE FROM submission WHERE id=?"} {
+		_, err = tx.Exec(q, sub.ID)
+		if err != nil {
+			return errors.Wrap(err, queryPrinter(q, sub.ID))
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "unable to commit removing submission")
+	}
+	return nil
+}
+
+// IsMessageProcessed reports if the Message-ID was recorded by MarkMessageProcessed
+func (s *MySQLStore) IsMessageProcessed(messageID string) (bool, error) {
+	q := "SELECT count(*) FROM processed_message WHERE message_id=?"
+	var count int
+	err := s.DB.QueryRow(q, messageID).Scan(&count)
+	if err != nil {
+		return false, errors.Wrap(err, queryPrinter(q, messageID))
+	}
+	return count > 0, nil
+}
+
+// MarkMessageProcessed records the Message-ID and reports false if it was already recorded
+func (s *MySQLStore) MarkMessageProcessed(messageID string) (bool, error) {
+	return s.insertIgnore("INSERT IGNORE INTO processed_message (message_id, received_at) VALUES (?, ?)", messageID, time.Now().UTC())
+}
+
+// PruneProcessedMessages forgets the Message-IDs recorded before the time, and returns how many
+func (s *MySQLStore) PruneProcessedMessages(before time.Time) (int64, error) {
+	q := "DELETE FROM processed_message WHERE received_at < ?"
+	res, err := s.DB.Exec(q, before.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, queryPrinter(q, before.UTC()))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, queryPrinter(q, before.UTC()))
+	}
+	return n, nil
+}
+
+// QueueMessage holds a message from a sender not on the allowlist. It sets qm.ID.
+func (s *MySQLStore) QueueMessage(qm *QueuedMessage) error {
+	q := "INSERT INTO queued_message (sender, recipient, subject, body, message_id, received_at) VALUES (?, ?, ?, ?, ?, ?)"
+	args := []interface{}{qm.From, qm.To, qm.Subject, qm.Text, qm.MessageID, qm.ReceivedAt.UTC()}
+	res, err := s.DB.Exec(q, args...)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, args...))
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "unable to get queued message id")
+	}
+	qm.ID = int(id)
+	return nil
+}
+
+// GetQueuedMessages lists the held messages, oldest first
+func (s *MySQLStore) GetQueuedMessages() ([]QueuedMessage, error) {
+	q := "SELECT id, sender, recipient, subject, body, message_id, received_at FROM queued_message ORDER BY id"
+	rows, err := s.DB.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, queryPrinter(q))
+	}
+	defer rows.Close()
+
+	var queued []QueuedMessage
+	for rows.Next() {
+		var qm QueuedMessage
+		err = rows.Scan(&qm.ID, &qm.From, &qm.To, &qm.Subject, &qm.Text, &qm.MessageID, &qm.ReceivedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, queryPrinter(q))
+		}
+		queued = append(queued, qm)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return queued, nil
+}
+
+// GetQueuedMessage is a single held message. It returns sql.ErrNoRows if there is none.
+func (s *MySQLStore) GetQueuedMessage(id int) (QueuedMessage, error) {
+	var qm QueuedMessage
+	q := "SELECT id, sender, recipient, subject, body, message_id, received_at FROM queued_message WHERE id=?"
+	err := s.DB.QueryRow(q, id).Scan(&qm.ID, &qm.From, &qm.To, &qm.Subject, &qm.Text, &qm.MessageID, &qm.ReceivedAt)
+	if err == sql.ErrNoRows {
+		return qm, err
+	} else if err != nil {
+		return qm, errors.Wrap(err, queryPrinter(q, id))
+	}
+	return qm, nil
+}
+
+// RemoveQueuedMessage deletes a held message, once it is approved or rejected
+func (s *MySQLStore) RemoveQueuedMessage(id int) error {
+	q := "DELETE FROM queued_message WHERE id=?"
+	_, err := s.DB.Exec(q, id)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, id))
+	}
+	return nil
+}
+
+// AddOutboxEmail saves a pending email. It sets email.ID.
+func (s *MySQLStore) AddOutboxEmail(email *OutboxEmail) error {
+	q := "INSERT INTO outbox (recipient, subject, text_body, body, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	args := []interface{}{email.To, email.Subject, email.Text, email.HTML, OutboxPending, email.NextAttemptAt.UTC(), time.Now().UTC()}
+	res, err := s.DB.Exec(q, args...)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, args...))
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "unable to get outbox id")
+	}
+	email.ID = int(id)
+	return nil
+}
+
+// GetDueOutboxEmails lists the pending emails whose next attempt is at or before now, oldest first
+func (s *MySQLStore) GetDueOutboxEmails(now time.Time) ([]OutboxEmail, error) {
+	return s.getOutboxEmails("WHERE status=? AND next_attempt_at <= ? ORDER BY id LIMIT 100", OutboxPending, now.UTC())
+}
+
+// GetStuckOutboxEmails lists the dead emails and the pending ones that have failed at least once, oldest first
+func (s *MySQLStore) GetStuckOutboxEmails() ([]OutboxEmail, error) {
+	return s.getOutboxEmails("WHERE status=? OR (status=? AND attempts > 0) ORDER BY id", OutboxDead, OutboxPending)
+}
+
+// getOutboxEmails runs a query on the outbox with the given conditions
+func (s *MySQLStore) getOutboxEmails(conditions string, args ...interface{}) ([]OutboxEmail, error) {
+	q := "SELECT id, recipient, subject, text_body, body, status, attempts, last_error, next_attempt_at, created_at FROM outbox " + conditions
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, queryPrinter(q, args...))
+	}
+	defer rows.Close()
+
+	var emails []OutboxEmail
+	for rows.Next() {
+		var email OutboxEmail
+		err = rows.Scan(&email.ID, &email.To, &email.Subject, &email.Text, &email.HTML, &email.Status, &email.Attempts, &email.LastError, &email.NextAttemptAt, &email.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, queryPrinter(q, args...))
+		}
+		emails = append(emails, email)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return emails, nil
+}
+
+// ClaimOutboxEmail pushes a due email's next attempt to until, and reports false if another worker claimed it first
+func (s *MySQLStore) ClaimOutboxEmail(id int, now time.Time, until time.Time) (bool, error) {
+	q := "UPDATE outbox SET next_attempt_at=? WHERE id=? AND status=? AND next_attempt_at <= ?"
+	args := []interface{}{until.UTC(), id, OutboxPending, now.UTC()}
+	res, err := s.DB.Exec(q, args...)
+	if err != nil {
+		return false, errors.Wrap(err, queryPrinter(q, args...))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, queryPrinter(q, args...))
+	}
+	return n > 0, nil
+}
+
+// PruneOutboxEmails deletes the sent emails created before the time, and returns how many
+func (s *MySQLStore) PruneOutboxEmails(before time.Time) (int64, error) {
+	q := "DELETE FROM outbox WHERE status=? AND created_at < ?"
+	res, err := s.DB.Exec(q, OutboxSent, before.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, queryPrinter(q, OutboxSent, before.UTC()))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, queryPrinter(q, OutboxSent, before.UTC()))
+	}
+	return n, nil
+}
+
+// MarkOutboxEmailSent records that the email went out
+func (s *MySQLStore) MarkOutboxEmailSent(id int) error {
+	q := "UPDATE outbox SET status=? WHERE id=?"
+	_, err := s.DB.Exec(q, OutboxSent, id)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, OutboxSent, id))
+	}
+	return nil
+}
+
+// MarkOutboxEmailFailed saves the email's status, attempts, last error, and next attempt after a failure
+func (s *MySQLStore) MarkOutboxEmailFailed(email OutboxEmail) error {
+	lastError := email.LastError
+	if len(lastError) > 1024 {
+		lastError = lastError[:1024]
+	}
+	status := email.Status
+	if status == "" {
+		status = OutboxPending
+	}
+	q := "UPDATE outbox SET status=?, attempts=?, last_error=?, next_attempt_at=? WHERE id=?"
+	args := []interface{}{status, email.Attempts, lastError, email.NextAttemptAt.UTC(), email.ID}
+	_, err := s.DB.Exec(q, args...)
+	if err != nil {
+		return errors.Wrap(err, queryPrinter(q, args...))
+	}
+	return nil
+}
+
+// insertIgnore runs an insert that skips duplicate keys and reports if a row went in
+func (s *MySQLStore) insertIgnore(q string, args ...interface{}) (bool, error) {
+	res, err := s.DB.Exec(q, args...)
+	if err != nil {
+		return false, errors.Wrap(err, queryPrinter(q, args...))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, queryPrinter(q, args...))
+	}
+	return n > 0, nil
+}
+
+// GetDigestUsers lists the users who opted in to any digest, with their timezone defaulted the same way as GetUserLocation
+func (s *MySQLStore) GetDigestUsers() ([]DigestUser, error) {
+	q := "SELECT user.id, user.email, user.digest, user.timezone, team.timezone FROM user LEFT JOIN user_team ON user_team.user_id=user.id LEFT JOIN team ON user_team.team_id=team.id WHERE user.digest != '' ORDER BY user.id, team.kind=? DESC, team.id"
+	rows, err := s.DB.Query(q, TeamKindOffice)
+	if err != nil {
+		return nil, errors.Wrap(err, queryPrinter(q, TeamKindOffice))
+	}
+	defer rows.Close()
+
+	// each user has a row per team, office first; the timezones are collected and then loaded once each
+	var users []DigestUser
+	var timezones []string
+	for rows.Next() {
+		var u DigestUser
+		var userTZ, teamTZ sql.NullString
+		err = rows.Scan(&u.ID, &u.Email, &u.Digest, &userTZ, &teamTZ)
+		if err != nil {
+			return nil, errors.Wrap(err, queryPrinter(q, TeamKindOffice))
+		}
+		if len(users) == 0 || users[len(users)-1].ID != u.ID {
+			users = append(users, u)
+			timezones = append(timezones, userTZ.String)
+		}
+		if last := len(timezones) - 1; timezones[last] == "" {
+			timezones[last] = teamTZ.String
+		}
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	locations := make(map[string]*time.Location)
+	for i, tz := range timezones {
+		if locations[tz] == nil {
+			locations[tz] = loadLocation(tz)
+		}
+		users[i].Location = locations[tz]
+	}
+	return users, nil
+}
+
+// IsDigestSent reports if the user's digest for the day, ie, 2016-11-14, was recorded
+func (s *MySQLStore) IsDigestSent(userID int, kind string, day string) (bool, error) {
+	q := "SELECT count(*) FROM digest_sent WHERE user_id=? AND kind=? AND day=?"
+	var count int
+	err := s.DB.QueryRow(q, userID, kind, day).Scan(&count)
+	if err != nil {
+		return false, errors.Wrap(err, queryPrinter(q, userID, kind, day))
+	}
+	return count > 0, nil
+}
+
+// MarkDigestSent records the user's digest for the day, ie, 2016-11-14, and reports false if it was already recorded
+func (s *MySQLStore) MarkDigestSent(userID int, kind string, day string) (bool, error) {
+	return s.insertIgnore("INSERT IGNORE INTO digest_sent (user_id, kind, day) VALUES (?, ?, ?)", userID, kind, day)
+}
+
+// Ping verifies the database is reachable
+func (s *MySQLStore) Ping() error {
+	_, err := s.DB.Exec("SELECT 1")
+	return err
+}
+
+// Close closes the database
+func (s *MySQLStore) Close() error {
+	return s.DB.Close()
+}
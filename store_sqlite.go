@@ -0,0 +1,28 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SQLiteStore is the Store backed by a SQLite file, for single binary deployments and tests.
+// The MySQLStore queries stick to SQL that SQLite also understands, so it reuses them
+// and only overrides the few that cannot.
+type SQLiteStore struct {
+	*MySQLStore
+}
+
+// NewSQLiteStore wraps an open sqlite3 db connection
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{MySQLStore: NewMySQLStore(db)}
+}
+
+// MarkMessageProcessed records the Message-ID and reports false if it was already recorded
+func (s *SQLiteStore) MarkMessageProcessed(messageID string) (bool, error) {
+	return s.insertIgnore("INSERT OR IGNORE INTO processed_message (message_id, received_at) VALUES (?, ?)", messageID, time.Now().UTC())
+}
+
+// MarkDigestSent records the user's digest for the day and reports false if it was already recorded
+func (s *SQLiteStore) MarkDigestSent(userID int, kind string, day string) (bool, error) {
+	return s.insertIgnore("INSERT OR IGNORE INTO digest_sent (user_id, kind, day) VALUES (?, ?, ?)", userID, kind, day)
+}
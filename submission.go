@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// UndoWindow is how far back the "undo" subject can reach
+var UndoWindow = 24 * time.Hour
+
+// Sources of a submission
+const (
+	SourceSendGrid = "sendgrid"
+	SourceMailgun  = "mailgun"
+	SourcePostmark = "postmark"
+	SourceJSON     = "json"
+	SourceSMTP     = "smtp"
+	// SourceQueue is a message an admin approved from the queue of rejected senders
+	SourceQueue = "queue"
+)
+
+// Submission is one inbound email that logged reps (the submission table) along with those reps
+type Submission struct {
+	ID         int
+	UserID     int
+	Sender     string
+	To         string
+	Subject    string
+	MessageID  string
+	ReceivedAt time.Time
+	// CreditedAt is when the reps count for (their created_at). Zero means ReceivedAt.
+	CreditedAt time.Time
+	Source     string
+
+	// Exercises are in the order they were logged
+	Exercises []string
+	Counts    map[string]int
+}
+
+// summary lists the reps in the submission, ie, "6 Pull Ups, 2 Push Ups"
+func (sub Submission) summary() string {
+	var parts []string
+	for _, exercise := range sub.Exercises {
+		parts = append(parts, fmt.Sprintf("%d %s", sub.Counts[exercise], exercise))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isUndoSubject reports if the subject asks to remove the last submission
+func isUndoSubject(subject string) bool {
+	return strings.EqualFold(strings.TrimSpace(subject), "undo")
+}
+
+// messageIDFromHeaders finds the Message-ID in the raw header block SendGrid posts as "headers"
+func messageIDFromHeaders(headers string) string {
+	if strings.TrimSpace(headers) == "" {
+		return ""
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(strings.TrimRight(headers, "\r\n") + "\r\n\r\n"))
+	if err != nil {
+		logError(nil, err, "unable to read inbound headers")
+		return ""
+	}
+	return strings.TrimSpace(msg.Header.Get("Message-Id"))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultTimezone is used for users and teams that have not set an IANA timezone
+var DefaultTimezone = "America/Los_Angeles"
+
+// loadLocation loads the IANA timezone, falling back to DefaultTimezone (and then UTC) when it is empty or unknown
+func loadLocation(name string) *time.Location {
+	for _, tz := range []string{strings.TrimSpace(name), DefaultTimezone} {
+		if tz == "" {
+			continue
+		}
+		loc, err := time.LoadLocation(tz)
+		if err == nil {
+			return loc
+		}
+		logError(nil, err, fmt.Sprintf("unable to load timezone %q", tz))
+	}
+	return time.UTC
+}
+
+// validTimezone reports if name is a loadable IANA timezone, ie, America/Denver
+func validTimezone(name string) bool {
+	// LoadLocation treats "" as UTC and "Local" as the server's zone; neither is something a user means to set
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// startOfDay is midnight of t's day in loc; this is correct across DST changes, unlike truncating by 24 hours
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// dayKey is the month-day bucket t falls in for loc, matching the dates from initRepData
+func dayKey(t time.Time, loc *time.Location) string {
+	t = t.In(loc)
+	return fmt.Sprintf("%d-%d", int(t.Month()), t.Day())
+}
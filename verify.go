@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ParseToken, when set, must be the token query parameter on the inbound parse URL, ie, /parseapi/index.php?token=...
+var ParseToken string
+
+// ParseHMACSecret, when set, means SignatureHeader must carry the hex HMAC-SHA256 of the request body with this secret
+var ParseHMACSecret string
+
+// SignatureHeader holds the request body's HMAC when ParseHMACSecret is set. A "sha256=" prefix is allowed.
+const SignatureHeader = "X-Countmyreps-Signature"
+
+// MaxInboundSize is the largest inbound webhook body accepted, in bytes. SendGrid caps a message at 30MB.
+var MaxInboundSize int64 = 30 << 20
+
+// errInboundTooLarge is returned by verifyWebhook for a body over MaxInboundSize
+var errInboundTooLarge = errors.New("request body is too large")
+
+// RequireSPF and RequireDKIM drop messages unless SendGrid's SPF and dkim fields report a pass for the sender
+var RequireSPF, RequireDKIM bool
+
+// verifyWebhook checks the token, size, and signature on an inbound parse request.
+// It reads the body and puts it back, so it must run before the form is parsed.
+func verifyWebhook(w http.ResponseWriter, r *http.Request) error {
+	if ParseToken != "" {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			return fmt.Errorf("missing token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ParseToken)) != 1 {
+			return fmt.Errorf("wrong token")
+		}
+	}
+
+	// the whole body is read here, so the form parsing after this can't be made to read more than MaxInboundSize
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxInboundSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return errInboundTooLarge
+		}
+		return fmt.Errorf("unable to read body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if ParseHMACSecret != "" {
+		signature := strings.TrimPrefix(strings.TrimSpace(r.Header.Get(SignatureHeader)), "sha256=")
+		if signature == "" {
+			return fmt.Errorf("missing %s header", SignatureHeader)
+		}
+		got, err := hex.DecodeString(signature)
+		if err != nil {
+			return fmt.Errorf("%s header is not hex", SignatureHeader)
+		}
+
+		mac := hmac.New(sha256.New, []byte(ParseHMACSecret))
+		mac.Write(body)
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return fmt.Errorf("wrong %s", SignatureHeader)
+		}
+	}
+	return nil
+}
+
+// verifySender checks the SPF and dkim results SendGrid reports for the message, when they are required.
+// spf is a single result, ie, "pass". dkim lists a result per signing domain, ie, "{@sendgrid.com : pass, @other.com : fail}".
+func verifySender(from string, spf string, dkim string) error {
+	if RequireSPF && !strings.EqualFold(strings.TrimSpace(spf), "pass") {
+		return fmt.Errorf("SPF result is %q, not pass", spf)
+	}
+	if RequireDKIM && !dkimPass(from, dkim) {
+		return fmt.Errorf("no passing DKIM signature for the sender's domain in %q", dkim)
+	}
+	return nil
+}
+
+// dkimPass reports if dkim has a pass from the sender's domain or a parent of it, ie, a pass for @sendgrid.com covers mail.sendgrid.com
+func dkimPass(from string, dkim string) bool {
+	addr := strings.ToLower(strings.TrimSpace(extractEmailAddr(from)))
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return false
+	}
+	domain := addr[at+1:]
+
+	dkim = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(dkim), "{"), "}")
+	for _, entry := range strings.Split(dkim, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[1]), "pass") {
+			continue
+		}
+		signer := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(parts[0]), "@"))
+		if signer != "" && (domain == signer || strings.HasSuffix(domain, "."+signer)) {
+			return true
+		}
+	}
+	return false
+}